@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/zoetrope/kube-porter/pkg"
+)
+
+// caCmd represents the ca command
+var caCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "Manage the local CA that issues the certificates of targets with tls",
+	Long: `Manage the local CA that issues the certificates of targets with tls.
+The CA is created in the state directory when it is used for the first time.`,
+}
+
+var caExportOpts struct {
+	file string
+}
+
+// caExportCmd represents the ca export command
+var caExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Print the certificate of the local CA in PEM format",
+	Long: `Print the certificate of the local CA in PEM format
+Add it to the trust store of your OS or browser to trust the local TLS listeners.
+
+$ kube-porter ca export --file kube-porter-ca.crt
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := pkg.NewClient(rootOpts.socket)
+		err := c.Ready()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "kube-porter is not yet running")
+			return err
+		}
+		cert, err := c.Get("/ca")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to get CA certificate: %v\n", err)
+			return err
+		}
+		if caExportOpts.file != "" {
+			return os.WriteFile(caExportOpts.file, []byte(cert), 0644)
+		}
+		fmt.Fprint(cmd.OutOrStdout(), cert)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(caCmd)
+	caCmd.AddCommand(caExportCmd)
+
+	caExportCmd.Flags().StringVar(&caExportOpts.file, "file", "", "path to write the certificate to instead of stdout")
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/zoetrope/kube-porter/pkg"
+)
+
+// hostsCmd represents the hosts command
+var hostsCmd = &cobra.Command{
+	Use:   "hosts",
+	Short: "Manage hosts file entries for forwarded services",
+	Long: `Manage hosts file entries for forwarded services.
+Only Service targets that have a dedicated loopback address are included.`,
+}
+
+// hostsExportCmd represents the hosts export command
+var hostsExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Print the loopback addresses of forwarded services in hosts file format",
+	Long: `Print the loopback addresses of forwarded services in hosts file format
+
+$ kube-porter hosts export | sudo tee -a /etc/hosts
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := pkg.NewClient(rootOpts.socket)
+		err := c.Ready()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "kube-porter is not yet running")
+			return err
+		}
+		var entries []pkg.HostEntry
+		err = c.GetJson("/hosts", &entries)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to get hosts: %v\n", err)
+			return err
+		}
+		for _, e := range entries {
+			fmt.Fprintln(cmd.OutOrStdout(), e.String())
+		}
+		return nil
+	},
+}
+
+// hostsApplyCmd represents the hosts apply command
+var hostsApplyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Write the forwarded services to the hosts file and keep them in sync",
+	Long: `Write the forwarded services to a delimited block in the hosts file.
+kube-porter keeps the block in sync as targets come and go, and removes it on stop.
+The hosts file is specified by --hosts-file when kube-porter starts, and kube-porter must have permission to write it.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := pkg.NewClient(rootOpts.socket)
+		err := c.Ready()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "kube-porter is not yet running")
+			return err
+		}
+		err = c.Post("/hosts")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to apply hosts file: %v\n", err)
+			return err
+		}
+		return nil
+	},
+}
+
+// hostsRemoveCmd represents the hosts remove command
+var hostsRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "Remove the forwarded services from the hosts file",
+	Long:  `Remove the forwarded services from the hosts file and stop keeping them in sync`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := pkg.NewClient(rootOpts.socket)
+		err := c.Ready()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "kube-porter is not yet running")
+			return err
+		}
+		err = c.Delete("/hosts")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to remove hosts file entries: %v\n", err)
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(hostsCmd)
+	hostsCmd.AddCommand(hostsExportCmd)
+	hostsCmd.AddCommand(hostsApplyCmd)
+	hostsCmd.AddCommand(hostsRemoveCmd)
+}
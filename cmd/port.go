@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/zoetrope/kube-porter/pkg"
+)
+
+// portCmd represents the port command
+var portCmd = &cobra.Command{
+	Use:   "port <target> <remote-port>",
+	Short: "Print the local port forwarded to a remote port of a target",
+	Long: `Print the local port forwarded to a remote port of a target.
+<target> is "<name>", "<namespace>/<name>" or "<type>/<namespace>/<name>",
+and <remote-port> is the remote side of the port mapping in the manifest.
+
+$ curl http://localhost:$(kube-porter port todo/todo 80)/
+`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := pkg.NewClient(rootOpts.socket)
+		err := c.Ready()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "kube-porter is not yet running")
+			return err
+		}
+		q := url.Values{}
+		q.Set("target", args[0])
+		q.Set("remote", args[1])
+		port, err := c.Get("/port?" + q.Encode())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to get port: %v\n", err)
+			return err
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), port)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(portCmd)
+}
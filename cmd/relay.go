@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/zoetrope/kube-porter/pkg"
+	"go.uber.org/zap"
+)
+
+var relayOpts struct {
+	listen string
+	probe  bool
+}
+
+// relayCmd represents the relay command
+var relayCmd = &cobra.Command{
+	Use:    "relay",
+	Short:  "Run the relay in a helper pod",
+	Long:   `Run the relay in a helper pod created by kube-porter to forward UDP ports, remote hosts and reverse tunnels.`,
+	Hidden: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if relayOpts.probe {
+			return pkg.ProbeRelay(relayOpts.listen)
+		}
+		logger, err := zap.NewProduction()
+		if err != nil {
+			return err
+		}
+		zap.ReplaceGlobals(logger)
+		return pkg.RunRelay(cmd.Context(), relayOpts.listen)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(relayCmd)
+
+	fs := relayCmd.Flags()
+	fs.StringVar(&relayOpts.listen, "listen", "127.0.0.1:9000", "address to listen on")
+	fs.BoolVar(&relayOpts.probe, "probe", false, "check that the relay listening on the address is running, and exit")
+}
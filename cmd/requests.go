@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/zoetrope/kube-porter/pkg"
+)
+
+var requestsOpts struct {
+	output string
+}
+
+// requestsCmd represents the requests command
+var requestsCmd = &cobra.Command{
+	Use:   "requests [<target>]",
+	Short: "Show the latest requests forwarded by the targets with protocol http",
+	Long: `Show the latest requests forwarded by the targets with protocol http.
+<target> is "<name>", "<namespace>/<name>" or "<type>/<namespace>/<name>".
+If it is omitted, the requests of all targets are shown.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := pkg.NewClient(rootOpts.socket)
+		err := c.Ready()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "kube-porter is not yet running")
+			return err
+		}
+		path := "/requests"
+		if len(args) == 1 {
+			path += "?" + url.Values{"target": {args[0]}}.Encode()
+		}
+
+		switch requestsOpts.output {
+		case "json":
+			requests, err := c.Get(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to get requests: %v\n", err)
+				return err
+			}
+			fmt.Fprint(os.Stdout, requests)
+		case "text":
+			var requests []pkg.RequestLog
+			err = c.GetJson(path, &requests)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to get requests: %v\n", err)
+				return err
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 1, 1, ' ', 0)
+			w.Write([]byte("Time\tTarget\tPort\tMethod\tHost\tPath\tStatus\tLatency\tError\n"))
+			for _, r := range requests {
+				w.Write([]byte(fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", r.Time.Local().Format(time.TimeOnly), r.Target, r.Port, r.Method, r.Host, r.Path, r.Status, r.Latency.Round(time.Millisecond), r.Error)))
+			}
+			return w.Flush()
+		}
+		return nil
+	},
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		for _, format := range supportedFormats {
+			if format == requestsOpts.output {
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid format: %s", requestsOpts.output)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(requestsCmd)
+
+	fs := requestsCmd.Flags()
+	fs.StringVar(&requestsOpts.output, "output", "text", fmt.Sprintf("Output format. One of: [%s]", strings.Join(supportedFormats, ", ")))
+}
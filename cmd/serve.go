@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -15,10 +16,19 @@ import (
 )
 
 var serveOpts struct {
-	manifest   string
-	kubeconfig string
-	logdir     string
-	debug      bool
+	manifest         string
+	kubeconfig       string
+	logdir           string
+	statedir         string
+	debug            bool
+	allowNonLoopback bool
+	hostsFile        string
+	apiProxyURL      string
+	apiQPS           float32
+	apiBurst         int
+	apiTimeout       time.Duration
+	apiDialTimeout   time.Duration
+	apiKeepAlive     time.Duration
 }
 
 // serveCmd represents the serve command
@@ -63,7 +73,23 @@ to quickly create a Cobra application.`,
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		logFilePath := cmd.Context().Value("logFilePath").(string)
-		s := pkg.NewServer(rootOpts.socket, serveOpts.kubeconfig, serveOpts.manifest, logFilePath)
+		s := pkg.NewServer(pkg.ServerOptions{
+			SocketAddr:       rootOpts.socket,
+			Kubeconfig:       serveOpts.kubeconfig,
+			Manifest:         serveOpts.manifest,
+			LogFilePath:      logFilePath,
+			StateDir:         serveOpts.statedir,
+			AllowNonLoopback: serveOpts.allowNonLoopback,
+			HostsFile:        serveOpts.hostsFile,
+			API: pkg.APIOptions{
+				ProxyURL:    serveOpts.apiProxyURL,
+				QPS:         serveOpts.apiQPS,
+				Burst:       serveOpts.apiBurst,
+				Timeout:     serveOpts.apiTimeout,
+				DialTimeout: serveOpts.apiDialTimeout,
+				KeepAlive:   serveOpts.apiKeepAlive,
+			},
+		})
 		return s.Run()
 	},
 }
@@ -76,7 +102,20 @@ func AddServeFlags(fs *pflag.FlagSet) {
 	}
 	fs.StringVar(&serveOpts.kubeconfig, "kubeconfig", defaultKubeconfig, "path to the kubeconfig file")
 	fs.StringVar(&serveOpts.logdir, "logdir", filepath.Join(os.TempDir(), "kube-porter"), "")
+	defaultStatedir := filepath.Join(os.TempDir(), "kube-porter")
+	if dir, err := os.UserConfigDir(); err == nil {
+		defaultStatedir = filepath.Join(dir, "kube-porter")
+	}
+	fs.StringVar(&serveOpts.statedir, "statedir", defaultStatedir, "directory to persist the state such as allocated ports")
 	fs.BoolVar(&serveOpts.debug, "debug", true, "Enable debug logging")
+	fs.BoolVar(&serveOpts.allowNonLoopback, "allow-non-loopback", false, "Allow forwarders to listen on non-loopback addresses such as 0.0.0.0")
+	fs.StringVar(&serveOpts.hostsFile, "hosts-file", "/etc/hosts", "path to the hosts file written by \"kube-porter hosts apply\"")
+	fs.StringVar(&serveOpts.apiProxyURL, "api-proxy-url", "", "proxy URL to connect to the API server, overriding proxy-url of kubeconfig and HTTPS_PROXY")
+	fs.Float32Var(&serveOpts.apiQPS, "api-qps", 0, "maximum QPS to the API server (0 uses the default of client-go)")
+	fs.IntVar(&serveOpts.apiBurst, "api-burst", 0, "maximum burst of requests to the API server (0 uses the default of client-go)")
+	fs.DurationVar(&serveOpts.apiTimeout, "api-timeout", 0, "timeout of each request to the API server (0 means no timeout)")
+	fs.DurationVar(&serveOpts.apiDialTimeout, "api-dial-timeout", 0, "timeout to connect to the API server")
+	fs.DurationVar(&serveOpts.apiKeepAlive, "api-keepalive", 0, "interval of TCP keepalive probes to the API server")
 }
 
 func init() {
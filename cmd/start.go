@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"strconv"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -51,6 +52,33 @@ to quickly create a Cobra application.`,
 		if len(serveOpts.logdir) != 0 {
 			opts = append(opts, "--logdir", serveOpts.logdir)
 		}
+		if len(serveOpts.statedir) != 0 {
+			opts = append(opts, "--statedir", serveOpts.statedir)
+		}
+		if serveOpts.allowNonLoopback {
+			opts = append(opts, "--allow-non-loopback")
+		}
+		if len(serveOpts.hostsFile) != 0 {
+			opts = append(opts, "--hosts-file", serveOpts.hostsFile)
+		}
+		if len(serveOpts.apiProxyURL) != 0 {
+			opts = append(opts, "--api-proxy-url", serveOpts.apiProxyURL)
+		}
+		if serveOpts.apiQPS != 0 {
+			opts = append(opts, "--api-qps", strconv.FormatFloat(float64(serveOpts.apiQPS), 'f', -1, 32))
+		}
+		if serveOpts.apiBurst != 0 {
+			opts = append(opts, "--api-burst", strconv.Itoa(serveOpts.apiBurst))
+		}
+		if serveOpts.apiTimeout != 0 {
+			opts = append(opts, "--api-timeout", serveOpts.apiTimeout.String())
+		}
+		if serveOpts.apiDialTimeout != 0 {
+			opts = append(opts, "--api-dial-timeout", serveOpts.apiDialTimeout.String())
+		}
+		if serveOpts.apiKeepAlive != 0 {
+			opts = append(opts, "--api-keepalive", serveOpts.apiKeepAlive.String())
+		}
 
 		serve := exec.Command(exe, opts...)
 		if err := serve.Start(); err != nil {
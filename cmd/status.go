@@ -44,9 +44,27 @@ var statusCmd = &cobra.Command{
 				return err
 			}
 			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 1, 1, ' ', 0)
-			w.Write([]byte("Type\tNamespace\tName\tPorts\tForwarding\n"))
+			w.Write([]byte("Type\tNamespace\tName\tAddress\tPorts\tForwarding\tState\tPod\tRestarts\tMessage\n"))
 			for _, f := range forwarderList {
-				w.Write([]byte(fmt.Sprintf("%s\t%s\t%s\t%s\t%v\n", f.ObjectType, f.Namespace, f.Name, strings.Join(f.Ports, ","), f.Forwarding)))
+				address := strings.Join(f.Address, ",")
+				if f.Loopback != "" {
+					address = f.Loopback
+				} else if address == "" {
+					address = "localhost"
+				}
+				ports := f.Ports
+				if len(f.ResolvedPorts) != 0 {
+					ports = f.ResolvedPorts
+				}
+				pod, restarts := "", ""
+				if f.Pod != nil {
+					pod = fmt.Sprintf("%s(%s)", f.Pod.Name, f.Pod.Phase)
+					restarts = fmt.Sprint(f.Pod.Restarts)
+					if f.Pod.LastTermination != "" {
+						restarts += " (" + f.Pod.LastTermination + ")"
+					}
+				}
+				w.Write([]byte(fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%v\t%s\t%s\t%s\t%s\n", f.ObjectType, f.Namespace, f.Name, address, strings.Join(ports, ","), f.Forwarding, f.State, pod, restarts, f.Message)))
 			}
 			return w.Flush()
 		}
@@ -0,0 +1,56 @@
+package pkg
+
+import (
+	"fmt"
+	"net"
+)
+
+var defaultAddresses = []string{"localhost"}
+
+func (t Target) addresses() []string {
+	if len(t.Address) == 0 {
+		return defaultAddresses
+	}
+	return t.Address
+}
+
+// listenAddresses returns the addresses to listen on for the target.
+// The dedicated loopback address takes precedence over Target.Address.
+func listenAddresses(t Target, loopback string) []string {
+	if loopback != "" {
+		return []string{loopback}
+	}
+	return t.addresses()
+}
+
+// validateAddresses checks that the addresses can be listened on,
+// and that none of them is reachable from other hosts unless allowNonLoopback is set.
+func validateAddresses(addresses []string, allowNonLoopback bool) error {
+	for _, addr := range addresses {
+		if addr == "localhost" {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("invalid address %q: must be localhost or an IP address", addr)
+		}
+		if !ip.IsLoopback() && !allowNonLoopback {
+			return fmt.Errorf("address %s is not a loopback address; start kube-porter with --allow-non-loopback to listen on it", addr)
+		}
+	}
+	return nil
+}
+
+// dialHost returns a host that can be used to connect to a listener bound to addr.
+func dialHost(addr string) string {
+	ip := net.ParseIP(addr)
+	switch {
+	case ip == nil:
+		return addr
+	case ip.Equal(net.IPv4zero):
+		return "127.0.0.1"
+	case ip.Equal(net.IPv6unspecified):
+		return "::1"
+	}
+	return addr
+}
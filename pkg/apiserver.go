@@ -0,0 +1,92 @@
+package pkg
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	"k8s.io/client-go/rest"
+)
+
+// APIOptions tunes the connections to the API server.
+// Zero values keep the defaults of client-go and kubeconfig.
+type APIOptions struct {
+	// ProxyURL overrides proxy-url of kubeconfig and the HTTPS_PROXY environment variable.
+	ProxyURL string
+	QPS      float32
+	Burst    int
+	// Timeout limits each API request. Port-forward connections are not affected.
+	Timeout     time.Duration
+	DialTimeout time.Duration
+	// KeepAlive is the interval of TCP keepalive probes. It does not apply to WebSocket port-forward connections,
+	// whose dialer cannot be configured.
+	KeepAlive time.Duration
+}
+
+func (o APIOptions) apply(config *rest.Config) error {
+	if o.ProxyURL != "" {
+		u, err := url.Parse(o.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("invalid proxy URL %q: %w", o.ProxyURL, err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("unsupported proxy scheme: %q", u.Scheme)
+		}
+		config.Proxy = http.ProxyURL(u)
+	}
+	if o.QPS != 0 {
+		config.QPS = o.QPS
+	}
+	if o.Burst != 0 {
+		config.Burst = o.Burst
+	}
+	if o.Timeout != 0 {
+		config.Timeout = o.Timeout
+	}
+	if d := o.netDialer(); d != nil {
+		config.Dial = d.DialContext
+	}
+	return nil
+}
+
+// netDialer returns the dialer of the connections to the API server, or nil to use the default one.
+func (o APIOptions) netDialer() *net.Dialer {
+	if o.DialTimeout == 0 && o.KeepAlive == 0 {
+		return nil
+	}
+	return &net.Dialer{
+		Timeout:   o.DialTimeout,
+		KeepAlive: o.KeepAlive,
+	}
+}
+
+// spdyRoundTripperFor is spdy.RoundTripperFor of client-go, which also uses dialer to connect if it is not nil.
+func spdyRoundTripperFor(config *rest.Config, dialer *net.Dialer) (http.RoundTripper, *spdy.SpdyRoundTripper, error) {
+	tlsConfig, err := rest.TLSConfigFor(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	proxy := http.ProxyFromEnvironment
+	if config.Proxy != nil {
+		proxy = config.Proxy
+	}
+	upgradeRoundTripper, err := spdy.NewRoundTripperWithConfig(spdy.RoundTripperConfig{
+		TLS:        tlsConfig,
+		Proxier:    proxy,
+		PingPeriod: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	upgradeRoundTripper.Dialer = dialer
+	wrapper, err := rest.HTTPWrappersForConfig(config, upgradeRoundTripper)
+	if err != nil {
+		return nil, nil, err
+	}
+	return wrapper, upgradeRoundTripper, nil
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strings"
 )
 
 type Client struct {
@@ -52,6 +54,9 @@ func (c *Client) Get(path string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if res.StatusCode/100 != 2 {
+		return "", fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(b)))
+	}
 	return string(b), nil
 }
 
@@ -69,6 +74,34 @@ func (c *Client) GetJson(path string, data any) error {
 	return nil
 }
 
+// Post sends a POST request and returns the response body as an error if the request failed.
+func (c *Client) Post(path string) error {
+	return c.do(http.MethodPost, path)
+}
+
+// Delete sends a DELETE request and returns the response body as an error if the request failed.
+func (c *Client) Delete(path string) error {
+	return c.do(http.MethodDelete, path)
+}
+
+func (c *Client) do(method string, path string) error {
+	req, err := http.NewRequest(method, "http://localhost"+path, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
 func (c *Client) Stop() error {
 	req, err := http.NewRequest(http.MethodDelete, "http://localhost/stop", nil)
 	if err != nil {
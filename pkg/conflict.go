@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// checkPortsAvailable tries to bind the local ports of the mappings on the hosts returned by Forwarder.listenHosts,
+// so that a port used by another process is reported instead of being retried blindly.
+func checkPortsAvailable(hosts []string, ports []string) error {
+	for _, port := range ports {
+		m, err := parsePortMapping(port)
+		if err != nil {
+			return err
+		}
+		if m.isUnix() {
+			// A socket file that nobody accepts on is a leftover, which is replaced when listening.
+			if conn, err := net.Dial("unix", m.unixPath()); err == nil {
+				conn.Close()
+				return fmt.Errorf("unix socket %s is already in use", m.unixPath())
+			}
+			continue
+		}
+		local, err := strconv.Atoi(m.local)
+		if err != nil || local == 0 {
+			continue
+		}
+		for _, addr := range hosts {
+			var l io.Closer
+			if m.udp {
+				l, err = net.ListenPacket("udp", net.JoinHostPort(addr, m.local))
+			} else {
+				l, err = net.Listen("tcp", net.JoinHostPort(addr, m.local))
+			}
+			if err == nil {
+				l.Close()
+				continue
+			}
+			if !errors.Is(err, syscall.EADDRINUSE) {
+				continue
+			}
+			if m.udp {
+				return fmt.Errorf("local port %s/udp is already in use", net.JoinHostPort(addr, m.local))
+			}
+			if owner := portOwner(local); owner != "" {
+				return fmt.Errorf("local port %s is already in use by %s", net.JoinHostPort(addr, m.local), owner)
+			}
+			return fmt.Errorf("local port %s is already in use", net.JoinHostPort(addr, m.local))
+		}
+	}
+	return nil
+}
+
+type localPort struct {
+	target  string
+	address string
+	port    string
+}
+
+// findPortConflicts returns an error for each target, keyed by Target.String(), whose explicit local ports
+// are also used by another target in the manifest. The targets in preferred are given the ports first.
+func findPortConflicts(targets []Target, addresses map[string][]string, preferred map[string]bool) map[string]error {
+	ordered := make([]Target, 0, len(targets))
+	for _, target := range targets {
+		if preferred[target.String()] {
+			ordered = append(ordered, target)
+		}
+	}
+	for _, target := range targets {
+		if !preferred[target.String()] {
+			ordered = append(ordered, target)
+		}
+	}
+
+	conflicts := make(map[string]error)
+	var used []localPort
+	for _, target := range ordered {
+		// Reverse targets connect to the local ports instead of listening on them.
+		if target.Ports.isAll() || target.ObjectType == "Reverse" {
+			continue
+		}
+		var ports []localPort
+	PORTS:
+		for _, port := range target.Ports {
+			m, err := parsePortMapping(port)
+			if err != nil || m.isAuto() {
+				continue
+			}
+			addrs := addresses[target.String()]
+			if m.isUnix() {
+				addrs = []string{"unix"}
+			}
+			local := m.local
+			if m.udp {
+				local += udpSuffix
+			}
+			for _, addr := range addrs {
+				for _, u := range used {
+					if u.target != target.String() && u.port == local && addressesOverlap(u.address, addr) {
+						conflicts[target.String()] = fmt.Errorf("local port %s is also used by %s", local, u.target)
+						break PORTS
+					}
+				}
+				ports = append(ports, localPort{target: target.String(), address: addr, port: local})
+			}
+		}
+		if conflicts[target.String()] == nil {
+			used = append(used, ports...)
+		}
+	}
+	return conflicts
+}
+
+// addressesOverlap reports whether listening on a and b with the same port would collide.
+func addressesOverlap(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ipA, ipB := listenIP(a), listenIP(b)
+	if ipA == nil || ipB == nil {
+		return false
+	}
+	for _, x := range ipA {
+		for _, y := range ipB {
+			if x.Equal(y) || (x.IsUnspecified() && (x.To4() != nil) == (y.To4() != nil)) || (y.IsUnspecified() && (x.To4() != nil) == (y.To4() != nil)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func listenIP(addr string) []net.IP {
+	if addr == "localhost" {
+		return []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil
+	}
+	return []net.IP{ip}
+}
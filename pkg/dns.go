@@ -0,0 +1,251 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsTTL             = 5
+	dnsUpstreamTimeout = 5 * time.Second
+)
+
+// dnsServer answers queries for forwarded Services with their loopback addresses
+// and relays all other queries to the upstream server.
+type dnsServer struct {
+	config   DNSConfig
+	upstream string
+	lookup   func(name string) (netip.Addr, bool)
+	logger   *zap.Logger
+
+	conn   net.PacketConn
+	cancel context.CancelFunc
+}
+
+func newDNSServer(config DNSConfig, lookup func(name string) (netip.Addr, bool)) *dnsServer {
+	return &dnsServer{
+		config: config,
+		lookup: lookup,
+		logger: zap.L().Named("dns"),
+	}
+}
+
+func (s *dnsServer) start(ctx context.Context) error {
+	s.upstream = s.config.Upstream
+	if s.upstream == "" {
+		upstream, err := systemNameserver(s.config.Listen)
+		if err != nil {
+			return err
+		}
+		s.upstream = upstream
+	}
+	if _, _, err := net.SplitHostPort(s.upstream); err != nil {
+		s.upstream = net.JoinHostPort(s.upstream, "53")
+	}
+	if reachesListener(s.config.Listen, s.upstream) {
+		return errors.New("dns.upstream must not be the address of the dns server itself: " + s.upstream)
+	}
+
+	conn, err := net.ListenPacket("udp", s.config.Listen)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+
+	ctx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go s.serve(ctx)
+
+	s.logger.Info("start dns server", zap.String("listen", conn.LocalAddr().String()), zap.String("upstream", s.upstream))
+	return nil
+}
+
+func (s *dnsServer) stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+func (s *dnsServer) serve(ctx context.Context) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger.Error("failed to read query", zap.Error(err))
+			}
+			return
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go s.handle(query, addr)
+	}
+}
+
+func (s *dnsServer) handle(query []byte, addr net.Addr) {
+	res, err := s.answer(query)
+	if err != nil {
+		s.logger.Debug("failed to parse query", zap.Error(err))
+		return
+	}
+	if res == nil {
+		res, err = s.relay(query)
+		if err != nil {
+			s.logger.Warn("failed to relay query", zap.String("upstream", s.upstream), zap.Error(err))
+			return
+		}
+	}
+	if _, err := s.conn.WriteTo(res, addr); err != nil {
+		s.logger.Warn("failed to write response", zap.Error(err))
+	}
+}
+
+// answer builds a response if the query is for a forwarded Service, otherwise it returns nil.
+func (s *dnsServer) answer(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	if q.Class != dnsmessage.ClassINET || (q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA) {
+		return nil, nil
+	}
+	ip, ok := s.lookup(q.Name.String())
+	if !ok {
+		return nil, nil
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+	switch {
+	case q.Type == dnsmessage.TypeA && ip.Is4():
+		err = b.AResource(rh, dnsmessage.AResource{A: ip.As4()})
+	case q.Type == dnsmessage.TypeAAAA && ip.Is6():
+		err = b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: ip.As16()})
+	}
+	// Other combinations get an empty answer, so that clients fall back to the other address family.
+	if err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+func (s *dnsServer) relay(query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", s.upstream, dnsUpstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(dnsUpstreamTimeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// systemNameserver returns the first nameserver in /etc/resolv.conf.
+// systemNameserver returns the first nameserver in /etc/resolv.conf other than the dns server listening on listen,
+// which it is once resolv.conf points to kube-porter.
+func systemNameserver(listen string) (string, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", errors.New("dns.upstream is required: " + err.Error())
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			addr := net.JoinHostPort(fields[1], "53")
+			if reachesListener(listen, addr) {
+				continue
+			}
+			return addr, nil
+		}
+	}
+	return "", errors.New("dns.upstream is required: no nameserver found in /etc/resolv.conf")
+}
+
+// reachesListener reports whether the queries sent to addr would be received by the server listening on listen.
+func reachesListener(listen, addr string) bool {
+	listenHost, listenPort, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != listenPort {
+		return false
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap().WithZone("")
+	if listenHost == "localhost" {
+		return ip.IsLoopback()
+	}
+	listenIP, err := netip.ParseAddr(listenHost)
+	if listenHost != "" && err != nil {
+		return false
+	}
+	if listenHost != "" && !listenIP.IsUnspecified() {
+		return listenIP.Unmap() == ip
+	}
+	// The server listens on all the addresses of the host.
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			if local, ok := netip.AddrFromSlice(n.IP); ok && local.Unmap() == ip {
+				return true
+			}
+		}
+	}
+	return false
+}
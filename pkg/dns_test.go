@@ -0,0 +1,31 @@
+package pkg
+
+import "testing"
+
+func TestReachesListener(t *testing.T) {
+	tests := []struct {
+		listen string
+		addr   string
+		want   bool
+	}{
+		{listen: "127.0.0.1:53", addr: "127.0.0.1:53", want: true},
+		{listen: "127.0.0.1:53", addr: "127.0.0.1:5353", want: false},
+		{listen: "127.0.0.1:53", addr: "127.0.0.53:53", want: false},
+		{listen: "127.0.0.1:53", addr: "8.8.8.8:53", want: false},
+		{listen: "[::1]:53", addr: "[::1]:53", want: true},
+		{listen: "localhost:53", addr: "127.0.0.1:53", want: true},
+		{listen: "localhost:53", addr: "[::1]:53", want: true},
+		{listen: "localhost:53", addr: "192.168.1.1:53", want: false},
+		{listen: ":53", addr: "127.0.0.1:53", want: true},
+		{listen: "0.0.0.0:53", addr: "127.0.0.53:53", want: true},
+		{listen: "0.0.0.0:53", addr: "8.8.8.8:53", want: false},
+		{listen: "127.0.0.1:53", addr: "dns.example.com:53", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.listen+" "+tt.addr, func(t *testing.T) {
+			if got := reachesListener(tt.listen, tt.addr); got != tt.want {
+				t.Errorf("reachesListener(%q, %q) = %v, want %v", tt.listen, tt.addr, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,343 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// forwardPorts is the port mappings of a target split by how they are forwarded.
+type forwardPorts struct {
+	// tcp are forwarded by client-go, and the others by the endpoints of kube-porter.
+	tcp    []string
+	unix   []portMapping
+	listen []portMapping
+	udp    []portMapping
+}
+
+func (p forwardPorts) needsPodTunnel() bool {
+	return len(p.unix) > 0 || len(p.listen) > 0
+}
+
+// splitPorts sorts the port mappings by how they are forwarded.
+func (t Target) splitPorts(ports []string) (forwardPorts, error) {
+	var p forwardPorts
+	for _, port := range ports {
+		m, err := parsePortMapping(port)
+		if err != nil {
+			return forwardPorts{}, err
+		}
+		switch {
+		case m.isUnix():
+			p.unix = append(p.unix, m)
+		case m.udp:
+			p.udp = append(p.udp, m)
+		case t.ownListener():
+			p.listen = append(p.listen, m)
+		default:
+			p.tcp = append(p.tcp, m.String())
+		}
+	}
+	return p, nil
+}
+
+// validateProtocol checks the protocol of the target and the settings that depend on it.
+func (t Target) validateProtocol() error {
+	if t.Protocol != "" && t.Protocol != protocolTCP && t.Protocol != protocolHTTP {
+		return fmt.Errorf("unsupported protocol: %s", t.Protocol)
+	}
+	if t.Rewrite != nil {
+		if t.Protocol != protocolHTTP {
+			return errors.New("rewrite requires protocol http")
+		}
+		if err := t.Rewrite.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endpoints are the local endpoints served by kube-porter itself: unix sockets, TCP listeners of the targets
+// that relay, parse or encrypt the connections, and UDP sockets. They are connected to the pod,
+// or to the remote host through the relay pod, by tunnels.
+type endpoints struct {
+	f   *Forwarder
+	ctx context.Context
+	// dest is the host to which the relay connects: the IP address of the pod, or the remote host.
+	dest   string
+	remote bool
+
+	podTunnel   *tunnel
+	relayTunnel *tunnel
+	tlsConfig   *tls.Config
+	upstreamTLS *tls.Config
+	// mappings are the unix and TCP mappings being served.
+	mappings []portMapping
+	closers  []io.Closer
+}
+
+// openEndpoints opens the tunnels and listens on the local endpoints of ports.
+// ctx is canceled with cancel when a tunnel is lost, and the endpoints are closed by close.
+func (f *Forwarder) openEndpoints(ctx context.Context, cancel context.CancelCauseFunc, clientset *kubernetes.Clientset, pod *corev1.Pod, ports forwardPorts) (*endpoints, error) {
+	e := &endpoints{
+		f:      f,
+		ctx:    ctx,
+		dest:   pod.Status.PodIP,
+		remote: f.target.ObjectType == "Remote",
+	}
+	if e.remote {
+		e.dest = f.target.remoteHost()
+	}
+
+	var err error
+	if f.target.TLS != nil {
+		e.tlsConfig, err = f.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if f.target.UpstreamTLS != nil {
+		e.upstreamTLS, err = f.upstreamTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := e.openTunnels(cancel, clientset, pod, ports); err != nil {
+		e.close()
+		return nil, err
+	}
+	if err := e.listen(ports); err != nil {
+		e.close()
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *endpoints) openTunnels(cancel context.CancelCauseFunc, clientset *kubernetes.Clientset, pod *corev1.Pod, ports forwardPorts) error {
+	if ports.needsPodTunnel() && !e.remote {
+		t, err := e.f.openTunnel(e.ctx, cancel, pod)
+		if err != nil {
+			return err
+		}
+		e.podTunnel = t
+		e.closers = append(e.closers, closerFunc(t.close))
+	}
+	if len(ports.udp) > 0 || e.remote {
+		// The port-forward subresource only supports TCP, so the datagrams are relayed by a pod in the cluster.
+		// For a Remote target, pod is the relay pod.
+		relay := pod
+		if !e.remote {
+			var err error
+			relay, err = e.f.ensureRelayPod(e.ctx, clientset, pod.Namespace)
+			if err != nil {
+				return err
+			}
+		}
+		t, err := e.f.openTunnel(e.ctx, cancel, relay)
+		if err != nil {
+			return err
+		}
+		e.relayTunnel = t
+		e.closers = append(e.closers, closerFunc(t.close))
+	}
+	return nil
+}
+
+func (e *endpoints) listen(ports forwardPorts) error {
+	f := e.f
+	for _, m := range ports.unix {
+		h, err := e.handler(m)
+		if err != nil {
+			return err
+		}
+		listener, err := f.listenUnix(m, h)
+		if err != nil {
+			f.logger.Error("failed to listen on unix socket", zap.String("path", m.unixPath()), zap.Error(err))
+			return err
+		}
+		e.mappings = append(e.mappings, m)
+		e.closers = append(e.closers, listener)
+	}
+	for _, m := range ports.listen {
+		h, err := e.handler(m)
+		if err != nil {
+			return err
+		}
+		listeners, err := f.listenTCP(m, h)
+		if err != nil {
+			f.logger.Error("failed to listen", zap.String("port", m.local), zap.Error(err))
+			return err
+		}
+		e.mappings = append(e.mappings, m)
+		for _, l := range listeners {
+			e.closers = append(e.closers, l)
+		}
+	}
+	for _, m := range ports.udp {
+		conns, err := f.listenUDP(e.relayTunnel, m, net.JoinHostPort(e.dest, m.remote))
+		if err != nil {
+			f.logger.Error("failed to listen on udp", zap.String("port", m.local), zap.Error(err))
+			return err
+		}
+		for _, c := range conns {
+			e.closers = append(e.closers, c)
+		}
+	}
+	return nil
+}
+
+// close closes the local endpoints, and then the tunnels.
+func (e *endpoints) close() {
+	for i := len(e.closers) - 1; i >= 0; i-- {
+		e.closers[i].Close()
+	}
+	e.closers = nil
+}
+
+// dialer returns the function that connects to the remote side of the mapping.
+func (e *endpoints) dialer(m portMapping) (func() (net.Conn, error), error) {
+	if e.remote {
+		addr := net.JoinHostPort(e.dest, m.remote)
+		return func() (net.Conn, error) {
+			return dialRelay(e.relayTunnel, "tcp", addr)
+		}, nil
+	}
+	port, err := strconv.Atoi(m.remote)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %s", m.remote)
+	}
+	return func() (net.Conn, error) {
+		return e.podTunnel.dial(port)
+	}, nil
+}
+
+// probeDialer returns the dialer of the mapping served on the local address,
+// with which the TCP health check probes the tunnel behind the listener.
+func (e *endpoints) probeDialer(network, addr string) (func() (net.Conn, error), error) {
+	for _, m := range e.mappings {
+		switch {
+		case network == "unix" && m.isUnix() && m.unixPath() == addr:
+			return e.dialer(m)
+		case network == "tcp" && !m.isUnix():
+			if _, port, _ := net.SplitHostPort(addr); port == m.local {
+				return e.dialer(m)
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s is not served by kube-porter", addr)
+}
+
+// handler returns the function that serves the connections accepted for the mapping.
+func (e *endpoints) handler(m portMapping) (func(net.Listener), error) {
+	d, err := e.dialer(m)
+	if err != nil {
+		return nil, err
+	}
+	if e.f.target.Protocol == protocolHTTP {
+		h := e.f.newHTTPProxy(m, d, e.upstreamTLS)
+		return func(l net.Listener) {
+			e.f.serveHTTP(e.ctx, l, h, e.tlsConfig)
+		}, nil
+	}
+	return func(l net.Listener) {
+		if e.tlsConfig != nil {
+			l = tls.NewListener(l, e.tlsConfig)
+		}
+		if e.upstreamTLS != nil {
+			e.f.serve(l, dialTLS(d, e.upstreamTLS))
+			return
+		}
+		e.f.serve(l, d)
+	}, nil
+}
+
+// listenUnix listens on the unix domain socket of the mapping and serves it with serve.
+// The socket file is removed when the listener is closed.
+func (f *Forwarder) listenUnix(m portMapping, serve func(net.Listener)) (net.Listener, error) {
+	path := m.unixPath()
+	// A socket file left by a crashed process prevents listening.
+	// checkPortsAvailable has already made sure that nobody is listening on it.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	f.logger.Info("forwarding from unix socket", zap.String("path", path), zap.String("remote", m.remote))
+	go serve(listener)
+	return listener, nil
+}
+
+// listenTCP listens on the local port of the mapping on every address and serves it with serve.
+func (f *Forwarder) listenTCP(m portMapping, serve func(net.Listener)) ([]net.Listener, error) {
+	listeners, err := listenEach(f.listenHosts(), m.local, func(addr string) (net.Listener, error) {
+		return net.Listen("tcp", addr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range listeners {
+		f.logger.Info("forwarding from", zap.String("address", l.Addr().String()), zap.String("remote", m.remote))
+		go serve(l)
+	}
+	return listeners, nil
+}
+
+// listenEach listens on port of every host with listen.
+// If one of them fails, the ones already opened are closed.
+func listenEach[T io.Closer](hosts []string, port string, listen func(addr string) (T, error)) ([]T, error) {
+	var listeners []T
+	for _, host := range hosts {
+		l, err := listen(net.JoinHostPort(host, port))
+		if err != nil {
+			if host == "::1" {
+				// IPv6 may be disabled, as client-go ignores it for "localhost".
+				continue
+			}
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// serve accepts connections until the listener is closed, and proxies each of them to a connection opened by dial.
+func (f *Forwarder) serve(listener net.Listener, dial func() (net.Conn, error)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			remote, err := dial()
+			if err != nil {
+				f.logger.Error("failed to connect to remote", zap.String("local", listener.Addr().String()), zap.Error(err))
+				conn.Close()
+				return
+			}
+			if err := proxyConn(conn, remote); err != nil {
+				f.logger.Debug("connection closed", zap.String("local", listener.Addr().String()), zap.Error(err))
+			}
+		}()
+	}
+}
+
+type closerFunc func() error
+
+func (c closerFunc) Close() error {
+	return c()
+}
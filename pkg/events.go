@@ -0,0 +1,138 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	maxEventSummaries     = 3
+	maxEventMessageLength = 200
+	maxEventAge           = 30 * time.Minute
+)
+
+// EventSummary is the latest Warning event of a reason for the target or its pods.
+type EventSummary struct {
+	Reason string `json:"reason"`
+	// Object is "<kind>/<name>" of the object the event is about.
+	Object   string    `json:"object"`
+	Message  string    `json:"message"`
+	Count    int32     `json:"count"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+func (e EventSummary) String() string {
+	return fmt.Sprintf("%s %s: %s", e.Reason, e.Object, e.Message)
+}
+
+// relatedEvents returns the summaries of the recent Warning events for the target object,
+// the ReplicaSets of a Deployment and pods, from the latest one.
+func (f *Forwarder) relatedEvents(ctx context.Context, clientset *kubernetes.Clientset, pods []*corev1.Pod) ([]EventSummary, error) {
+	events, err := clientset.CoreV1().Events(f.target.Namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: "type=" + corev1.EventTypeWarning,
+	})
+	if err != nil {
+		return nil, err
+	}
+	podNames := make(map[string]bool, len(pods))
+	for _, pod := range pods {
+		podNames[pod.Name] = true
+	}
+	related := func(obj corev1.ObjectReference) bool {
+		switch {
+		case obj.Kind == f.target.ObjectType && obj.Name == f.target.Name:
+			return true
+		case obj.Kind == "ReplicaSet" && f.target.ObjectType == "Deployment":
+			return strings.HasPrefix(obj.Name, f.target.Name+"-")
+		case obj.Kind == "Pod":
+			return podNames[obj.Name]
+		}
+		return false
+	}
+
+	latest := make(map[string]EventSummary)
+	for _, e := range events.Items {
+		if !related(e.InvolvedObject) || time.Since(eventTime(&e)) > maxEventAge {
+			continue
+		}
+		summary := EventSummary{
+			Reason:   e.Reason,
+			Object:   e.InvolvedObject.Kind + "/" + e.InvolvedObject.Name,
+			Message:  truncate(strings.TrimSpace(e.Message), maxEventMessageLength),
+			Count:    e.Count,
+			LastSeen: eventTime(&e),
+		}
+		if prev, ok := latest[e.Reason]; !ok || summary.LastSeen.After(prev.LastSeen) {
+			latest[e.Reason] = summary
+		}
+	}
+
+	summaries := make([]EventSummary, 0, len(latest))
+	for _, s := range latest {
+		summaries = append(summaries, s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].LastSeen.After(summaries[j].LastSeen)
+	})
+	if len(summaries) > maxEventSummaries {
+		summaries = summaries[:maxEventSummaries]
+	}
+	return summaries, nil
+}
+
+// withEvents records the events related to the target, and adds them to err so that they appear in the status and logs.
+func (f *Forwarder) withEvents(ctx context.Context, clientset *kubernetes.Clientset, pods []*corev1.Pod, err error) error {
+	summaries, listErr := f.relatedEvents(ctx, clientset, pods)
+	if listErr != nil {
+		f.logger.Debug("failed to list events", zap.Error(listErr))
+	}
+	f.setEvents(summaries)
+	if len(summaries) == 0 {
+		return err
+	}
+	texts := make([]string, 0, len(summaries))
+	for _, s := range summaries {
+		texts = append(texts, s.String())
+	}
+	return fmt.Errorf("%w; events: %s", err, strings.Join(texts, "; "))
+}
+
+func (f *Forwarder) setEvents(events []EventSummary) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = events
+}
+
+func (f *Forwarder) getEvents() []EventSummary {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.events
+}
+
+// eventTime returns when the event was observed last.
+func eventTime(e *corev1.Event) time.Time {
+	switch {
+	case e.Series != nil && !e.Series.LastObservedTime.IsZero():
+		return e.Series.LastObservedTime.Time
+	case !e.LastTimestamp.IsZero():
+		return e.LastTimestamp.Time
+	case !e.EventTime.IsZero():
+		return e.EventTime.Time
+	}
+	return e.CreationTimestamp.Time
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -2,19 +2,22 @@ package pkg
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"sort"
 	"strconv"
-	"strings"
-	"sync/atomic"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapio"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/httpstream"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
@@ -26,26 +29,70 @@ import (
 	"k8s.io/kubectl/pkg/util/podutils"
 )
 
+type ForwarderState string
+
+const (
+	StateWaiting      ForwarderState = "waiting"
+	StateForwarding   ForwarderState = "forwarding"
+	StateUnhealthy    ForwarderState = "unhealthy"
+	StateFailed       ForwarderState = "failed"
+	StatePortConflict ForwarderState = "port-conflict"
+	StateForbidden    ForwarderState = "forbidden"
+	StateNotReady     ForwarderState = "not-ready"
+)
+
+// stateError is an error that puts the forwarder into a specific state.
+type stateError struct {
+	state ForwarderState
+	err   error
+}
+
+func (e *stateError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stateError) Unwrap() error {
+	return e.err
+}
+
 type Forwarder struct {
 	config     *rest.Config
 	restClient rest.Interface
+	dialer     *net.Dialer
 	target     Target
 	logger     *zap.Logger
-	forwarding atomic.Bool
 	cancel     context.CancelFunc
 	exitCh     chan bool
+	// wg waits for the goroutine started by Run, which deletes the relay pod when it returns.
+	wg sync.WaitGroup
+	// loopback is the dedicated loopback address allocated to the target, if any.
+	loopback  string
+	allocator *portAllocator
+	// requests records the requests of the targets whose protocol is "http".
+	requests *requestLog
+	// ca issues the certificates of the targets with TLS.
+	ca *localCA
+	// blocked is the reason why the forwarder is not started.
+	blocked *stateError
+	// relayPod is the relay pod created for the UDP ports or the Remote host, which is deleted when the forwarder stops.
+	relayPod *metav1.ObjectMeta
+	// accessChecked is true once checkAccess has passed. It is reset by a Forbidden error,
+	// so that the access is reviewed only when the permissions may have changed.
+	accessChecked bool
+
+	mu      sync.RWMutex
+	state   ForwarderState
+	message string
+	// resolvedPorts is Target.Ports with the auto local ports replaced by the allocated ones.
+	resolvedPorts []string
+	// pod is the status of the pod selected for the target when it was last looked up.
+	pod *PodStatus
+	// events are the Warning events related to the target when no ready pod was found.
+	events []EventSummary
 }
 
-func NewForwarder(kubeconfig string, target Target) (*Forwarder, error) {
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
-	if err != nil {
-		return nil, err
-	}
-
-	config.APIPath = "/api"
-	config.GroupVersion = &corev1.SchemeGroupVersion
-	config.NegotiatedSerializer = scheme.Codecs.WithoutConversion()
-	restClient, err := rest.RESTClientFor(config)
+func NewForwarder(kubeconfig string, api APIOptions, target Target) (*Forwarder, error) {
+	config, restClient, err := newRESTClient(kubeconfig, api)
 	if err != nil {
 		return nil, err
 	}
@@ -53,26 +100,56 @@ func NewForwarder(kubeconfig string, target Target) (*Forwarder, error) {
 	return &Forwarder{
 		config:     config,
 		restClient: restClient,
+		dialer:     api.netDialer(),
 		target:     target,
 		logger:     zap.L().Named(target.Name),
+		exitCh:     make(chan bool),
+		allocator:  &portAllocator{ports: make(map[string]map[string]int)},
+		state:      StateWaiting,
 	}, nil
 }
 
 func (f *Forwarder) Run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	f.cancel = cancel
+	f.wg.Add(1)
 	go func() {
-		ctx, cancel := context.WithCancel(ctx)
-		f.cancel = cancel
-
-		timeout := 1 * time.Second
+		defer f.wg.Done()
+		defer f.deleteRelayPod()
+		b := newBackoff(f.target.Retry)
 		for {
+			var timeout time.Duration
 			err := f.forward(ctx)
 			if err != nil {
-				if timeout < 30*time.Second {
-					timeout *= 2
+				if ctx.Err() != nil {
+					return
+				}
+				var ok bool
+				timeout, ok = b.failure()
+				if !ok {
+					f.logger.Error("give up forwarding", zap.Int("failures", b.failures), zap.Error(err))
+					f.setState(StateFailed, fmt.Sprintf("gave up after %d failures: %v", b.failures, err))
+					return
+				}
+				state := StateWaiting
+				var se *stateError
+				if errors.As(err, &se) {
+					state = se.state
+				} else if apierrors.IsForbidden(err) {
+					state = StateForbidden
+				}
+				if state == StateForbidden {
+					f.accessChecked = false
+				}
+				// Repeating the same error on every retry only floods the log.
+				if prevState, prevMessage := f.getState(); prevState == state && prevMessage == err.Error() {
+					f.logger.Debug("failed to forward", zap.Duration("retryAfter", timeout), zap.Error(err))
+				} else {
+					f.logger.Error("failed to forward", zap.Duration("retryAfter", timeout), zap.Error(err))
 				}
-				f.logger.Error("failed to forward", zap.Error(err))
+				f.setState(state, err.Error())
 			} else {
-				timeout = 1 * time.Second
+				timeout = b.success()
 			}
 			select {
 			case <-ctx.Done():
@@ -89,10 +166,17 @@ func (f *Forwarder) Stop() {
 		return
 	default:
 		close(f.exitCh)
-		f.cancel()
+		if f.cancel != nil {
+			f.cancel()
+		}
 	}
 }
 
+// Wait waits for the forwarder started by Run to stop and clean up.
+func (f *Forwarder) Wait() {
+	f.wg.Wait()
+}
+
 func (f *Forwarder) isStopped() bool {
 	select {
 	case <-f.exitCh:
@@ -121,111 +205,476 @@ func (f *Forwarder) getObject(ctx context.Context, clientset *kubernetes.Clients
 	return obj, nil
 }
 
+func (f *Forwarder) setState(state ForwarderState, message string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state = state
+	f.message = message
+}
+
+func (f *Forwarder) getState() (ForwarderState, string) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.state, f.message
+}
+
+func (f *Forwarder) getResolvedPorts() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.resolvedPorts
+}
+
 func (f *Forwarder) forward(ctx context.Context) error {
-	defer f.forwarding.Store(false)
+	defer func() {
+		if state, _ := f.getState(); state == StateForwarding {
+			f.setState(StateWaiting, "")
+		}
+	}()
+	if f.target.ObjectType == "Reverse" {
+		return f.reverse(ctx)
+	}
+	ports, err := f.earlyPorts()
+	if err != nil {
+		return err
+	}
+
 	clientset, err := kubernetes.NewForConfig(f.config)
 	if err != nil {
 		return err
 	}
+	if err := f.checkAccess(ctx, clientset); err != nil {
+		return err
+	}
 
-	obj, err := f.getObject(ctx, clientset)
+	var pod *corev1.Pod
+	if f.target.ObjectType == "Remote" {
+		// A remote host has no pod, so the relay pod connects to it instead.
+		pod, err = f.ensureRelayPod(ctx, clientset, f.target.Namespace)
+	} else {
+		pod, ports, err = f.findPod(ctx, clientset, ports)
+	}
 	if err != nil {
 		return err
 	}
+	if err := f.target.validateProtocol(); err != nil {
+		return err
+	}
+	split, err := f.target.splitPorts(ports)
+	if err != nil {
+		return err
+	}
+
+	// fwCtx is canceled when the daemon stops, when the health check fails, when the connection is lost, or when forward returns.
+	fwCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	e, err := f.openEndpoints(fwCtx, cancel, clientset, pod, split)
+	if err != nil {
+		return err
+	}
+	defer e.close()
+
+	readyChan := make(chan struct{})
+	var fw *portforward.PortForwarder
+	if len(split.tcp) > 0 {
+		fw, err = f.newPortForwarder(fwCtx, pod, split.tcp, readyChan)
+		if err != nil {
+			return err
+		}
+	}
+
+	if f.target.HealthCheck != nil {
+		go func() {
+			select {
+			case <-fwCtx.Done():
+				return
+			case <-readyChan:
+			}
+			if err := f.runHealthCheck(fwCtx, fw, e); err != nil {
+				cancel(err)
+			}
+		}()
+	}
+
+	f.setState(StateForwarding, "")
+	f.logger.Info("start forwarding")
+	if fw != nil {
+		err = fw.ForwardPorts()
+		if err != nil {
+			f.logger.Error("failed to ForwardPorts", zap.Error(err))
+			return err
+		}
+	} else {
+		close(readyChan)
+		<-fwCtx.Done()
+	}
+	if cause := context.Cause(fwCtx); cause != nil && !errors.Is(cause, context.Canceled) {
+		return cause
+	}
+	if ctx.Err() != nil {
+		f.logger.Info("stop forwarding")
+		return nil
+	}
+	f.logger.Info("lost connection")
+	return nil
+}
+
+// earlyPorts resolves the ports as early as possible, so that the allocated ones can be looked up
+// even if the cluster is unreachable. "all" has to wait for the object and its pod, and returns nil.
+func (f *Forwarder) earlyPorts() ([]string, error) {
+	switch {
+	case !f.target.Ports.isAll():
+		return f.preparePorts(f.target.Ports)
+	case f.target.ObjectType == "Remote":
+		ports, err := f.target.remotePorts()
+		if err != nil {
+			return nil, err
+		}
+		return f.preparePorts(ports)
+	}
+	return nil, nil
+}
+
+// newPortForwarder returns the client-go forwarder of the TCP ports, which stops when ctx is canceled.
+func (f *Forwarder) newPortForwarder(ctx context.Context, pod *corev1.Pod, ports []string, readyChan chan struct{}) (*portforward.PortForwarder, error) {
+	l := f.logger.WithOptions(zap.WithCaller(false)).With(zap.String("forwarder", f.target.String()))
+	stdoutLogger := &zapio.Writer{Log: l, Level: zap.InfoLevel}
+	stderrLogger := &zapio.Writer{Log: l, Level: zap.ErrorLevel}
+	stopChan := make(chan struct{})
+	dialer, err := f.newDialer(pod)
+	if err != nil {
+		return nil, err
+	}
+	fw, err := portforward.NewOnAddresses(dialer, f.addresses(), ports, stopChan, readyChan, stdoutLogger, stderrLogger)
+	if err != nil {
+		f.logger.Error("failed to NewOnAddresses", zap.Error(err))
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		close(stopChan)
+	}()
+	return fw, nil
+}
+
+// findPod returns the pod to forward to, and the ports translated to its container ports.
+func (f *Forwarder) findPod(ctx context.Context, clientset *kubernetes.Clientset, ports []string) (*corev1.Pod, []string, error) {
+	obj, err := f.getObject(ctx, clientset)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	namespace, selector, err := polymorphichelpers.SelectorsForObject(obj)
 	if err != nil {
 		f.logger.Error("cannot attach to", zap.String("type", fmt.Sprintf("%T", obj)), zap.Error(err))
-		return err
+		return nil, nil, err
 	}
-	sortBy := func(pods []*corev1.Pod) sort.Interface { return sort.Reverse(podutils.ActivePods(pods)) }
-	pod, _, err := polymorphichelpers.GetFirstPod(clientset.CoreV1(), namespace, selector.String(), 1*time.Second, sortBy)
+	pod, err := f.selectPod(ctx, clientset, namespace, selector.String())
 	if err != nil {
-		f.logger.Error("failed to get first pod", zap.Error(err))
-		return err
+		return nil, nil, err
+	}
+
+	if f.target.Ports.isAll() {
+		ports, err = f.preparePorts(expandAllPorts(f.target.Ports, obj, pod, f.target.Container))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(ports) == 0 {
+			return nil, nil, fmt.Errorf("no TCP port is declared in %s", f.target.id())
+		}
 	}
-	//TODO: check pod status and rbac
 
-	var ports []string
+	orig := ports
 	if f.target.ObjectType == "Service" {
-		ports, err = translatePorts(f.target.Ports, obj.(*corev1.Service), pod)
-		f.logger.Info("translated ports", zap.Strings("orig", f.target.Ports), zap.Strings("translated", ports))
+		ports, err = translatePorts(orig, obj.(*corev1.Service), pod)
 	} else {
-		ports = f.target.Ports
+		ports, err = translateContainerPorts(orig, pod, f.target.Container)
+	}
+	if err != nil {
+		f.logger.Error("failed to translate ports", zap.Error(err))
+		return nil, nil, err
 	}
+	f.logger.Info("translated ports", zap.Strings("orig", orig), zap.Strings("translated", ports))
 	f.logger.Info("found pod", zap.String("pod", pod.Namespace+"/"+pod.Name))
+	return pod, ports, nil
+}
+
+// selectPod returns the most active pod matching selector whose relevant containers are ready.
+// If AllowNotReady is set, the most active pod is returned even if it is not ready.
+func (f *Forwarder) selectPod(ctx context.Context, clientset *kubernetes.Clientset, namespace, selector string) (*corev1.Pod, error) {
+	podList, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	if len(podList.Items) == 0 {
+		f.setPodStatus(nil)
+		return nil, f.withEvents(ctx, clientset, nil, fmt.Errorf("no pod found for %s", f.target.id()))
+	}
+	pods := make([]*corev1.Pod, 0, len(podList.Items))
+	for i := range podList.Items {
+		pods = append(pods, &podList.Items[i])
+	}
+	sort.Sort(sort.Reverse(podutils.ActivePods(pods)))
+
+	pod := pods[0]
+	for _, p := range pods {
+		if isPodReady(p, f.target.Container) {
+			pod = p
+			break
+		}
+	}
+	status := newPodStatus(pod, f.target.Container)
+	f.setPodStatus(status)
+	if !status.Ready && !f.target.AllowNotReady {
+		err := fmt.Errorf("pod %s is not ready: %s", pod.Name, status.describe())
+		return nil, f.withEvents(ctx, clientset, pods, &stateError{state: StateNotReady, err: err})
+	}
+	f.setEvents(nil)
+	return pod, nil
+}
+
+func (f *Forwarder) setPodStatus(status *PodStatus) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pod = status
+}
+
+func (f *Forwarder) getPodStatus() *PodStatus {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.pod
+}
+
+func (f *Forwarder) newDialer(pod *corev1.Pod) (httpstream.Dialer, error) {
+	dialer, err := newPodDialer(f.config, f.restClient, pod, f.target.Transport, f.dialer)
+	if err != nil {
+		f.logger.Error("failed to create dialer", zap.Error(err))
+		return nil, err
+	}
+	return dialer, nil
+}
+
+// newRESTClient returns the config of the cluster and a client for the core API group.
+// proxy-url of kubeconfig and the HTTPS_PROXY environment variable are honored unless api overrides them.
+func newRESTClient(kubeconfig string, api APIOptions) (*rest.Config, rest.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := api.apply(config); err != nil {
+		return nil, nil, err
+	}
 
-	req := f.restClient.Post().
+	config.APIPath = "/api"
+	config.GroupVersion = &corev1.SchemeGroupVersion
+	config.NegotiatedSerializer = scheme.Codecs.WithoutConversion()
+	restClient, err := rest.RESTClientFor(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, restClient, nil
+}
+
+// newPodDialer returns a dialer for the port-forward subresource of the pod.
+// transport is "auto" (default), "websocket" or "spdy". "auto" tries WebSocket first like kubectl,
+// and falls back to SPDY if the API server (or a proxy in front of it) does not upgrade the connection.
+func newPodDialer(config *rest.Config, restClient rest.Interface, pod *corev1.Pod, transport string, dialer *net.Dialer) (httpstream.Dialer, error) {
+	req := restClient.Post().
 		Resource("pods").
 		Namespace(pod.Namespace).
 		Name(pod.Name).
-		SubResource("portforward")
+		SubResource("portforward").
+		// The timeout of API requests does not apply to the long-running port-forward.
+		Timeout(0)
 
-	transport, upgrader, err := spdy.RoundTripperFor(f.config)
+	roundTripper, upgrader, err := spdyRoundTripperFor(config, dialer)
 	if err != nil {
-		f.logger.Error("failed to RoundTripperFor", zap.Error(err))
-		return err
+		return nil, err
+	}
+	spdyDialer := spdy.NewDialer(upgrader, &http.Client{Transport: roundTripper}, "POST", req.URL())
+	switch transport {
+	case transportSPDY:
+		return spdyDialer, nil
+	case "", transportAuto, transportWebSocket:
+	default:
+		return nil, fmt.Errorf("unsupported transport: %s", transport)
 	}
-	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, "POST", req.URL())
 
-	l := f.logger.WithOptions(zap.WithCaller(false)).With(zap.String("forwarder", f.target.String()))
-	stdoutLogger := &zapio.Writer{Log: l, Level: zap.InfoLevel}
-	stderrLogger := &zapio.Writer{Log: l, Level: zap.ErrorLevel}
-	stopChan := make(chan struct{})
-	readyChan := make(chan struct{})
-	fw, err := portforward.NewOnAddresses(dialer, []string{"localhost"}, ports, stopChan, readyChan, stdoutLogger, stderrLogger)
+	websocketDialer, err := portforward.NewSPDYOverWebsocketDialer(req.URL(), config)
 	if err != nil {
-		f.logger.Error("failed to NewOnAddresses", zap.Error(err))
-		return err
+		return nil, err
+	}
+	if transport == transportWebSocket {
+		return websocketDialer, nil
+	}
+	return portforward.NewFallbackDialer(websocketDialer, spdyDialer, func(err error) bool {
+		fallback := httpstream.IsUpgradeFailure(err) || httpstream.IsHTTPSProxyError(err)
+		if fallback {
+			zap.L().Debug("falling back to SPDY", zap.String("pod", pod.Namespace+"/"+pod.Name), zap.Error(err))
+		}
+		return fallback
+	}), nil
+}
+
+// openTunnel connects to the pod, and cancels the forwarding with cancel when the connection is lost.
+func (f *Forwarder) openTunnel(ctx context.Context, cancel context.CancelCauseFunc, pod *corev1.Pod) (*tunnel, error) {
+	dialer, err := f.newDialer(pod)
+	if err != nil {
+		return nil, err
+	}
+	t, err := dialTunnel(dialer, pod.Name)
+	if err != nil {
+		f.logger.Error("failed to dial tunnel", zap.String("pod", pod.Namespace+"/"+pod.Name), zap.Error(err))
+		return nil, err
 	}
 	go func() {
-		//TODO: exit goroutine when connection lost
-		<-ctx.Done()
-		f.logger.Info("stop forwarding")
-		stopChan <- struct{}{}
+		select {
+		case <-t.closeChan():
+			cancel(portforward.ErrLostConnectionToPod)
+		case <-ctx.Done():
+		}
 	}()
+	return t, nil
+}
 
-	f.forwarding.Store(true)
-	f.logger.Info("start forwarding")
-	err = fw.ForwardPorts()
+func (f *Forwarder) addresses() []string {
+	return listenAddresses(f.target, f.loopback)
+}
+
+// listenHosts returns the addresses to listen on, with "localhost" expanded to the IPv4 and IPv6 loopback addresses.
+func (f *Forwarder) listenHosts() []string {
+	var hosts []string
+	for _, addr := range f.addresses() {
+		if addr == "localhost" {
+			hosts = append(hosts, "127.0.0.1", "::1")
+			continue
+		}
+		hosts = append(hosts, addr)
+	}
+	return hosts
+}
+
+// preparePorts allocates the auto local ports and checks that the local ports are available.
+func (f *Forwarder) preparePorts(ports []string) ([]string, error) {
+	ports, err := f.allocator.resolvePorts(f.target.id(), ports)
 	if err != nil {
-		f.logger.Error("failed to ForwardPorts", zap.Error(err))
-		return err
+		return nil, err
 	}
-	f.logger.Info("lost connection")
-	return nil
+	f.mu.Lock()
+	f.resolvedPorts = ports
+	f.mu.Unlock()
+
+	if err := checkPortsAvailable(f.listenHosts(), ports); err != nil {
+		return nil, &stateError{state: StatePortConflict, err: err}
+	}
+	return ports, nil
 }
 
-func (f *Forwarder) isForwarding() bool {
-	return f.forwarding.Load()
+// runHealthCheck probes the forwarded port until ctx is canceled.
+// It returns an error after FailureThreshold consecutive failures.
+func (f *Forwarder) runHealthCheck(ctx context.Context, fw *portforward.PortForwarder, e *endpoints) error {
+	hc := f.target.HealthCheck
+	network, addr, err := f.healthCheckAddress(fw, hc.port())
+	var remote func() (net.Conn, error)
+	if err == nil && hc.probesTunnel() {
+		remote, err = e.probeDialer(network, addr)
+	}
+	if err != nil {
+		f.setState(StateUnhealthy, err.Error())
+		return &stateError{state: StateUnhealthy, err: err}
+	}
+
+	ticker := time.NewTicker(hc.interval())
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		err := hc.probe(ctx, network, addr, f.target.TLS != nil, remote)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == nil {
+			if failures > 0 {
+				f.logger.Info("health check recovered", zap.String("address", addr))
+				f.setState(StateForwarding, "")
+			}
+			failures = 0
+			continue
+		}
+
+		failures++
+		f.logger.Warn("health check failed", zap.String("address", addr), zap.Int("failures", failures), zap.Error(err))
+		if failures >= hc.failureThreshold() {
+			err = fmt.Errorf("health check failed %d times: %w", failures, err)
+			f.setState(StateUnhealthy, err.Error())
+			return &stateError{state: StateUnhealthy, err: err}
+		}
+	}
+}
+
+// healthCheckAddress returns the local address of the mapping whose remote side is port.
+func (f *Forwarder) healthCheckAddress(fw *portforward.PortForwarder, port string) (string, string, error) {
+	var forwarded []portforward.ForwardedPort
+	if fw != nil {
+		var err error
+		forwarded, err = fw.GetPorts()
+		if err != nil {
+			return "", "", err
+		}
+	}
+	i := 0
+	for _, p := range f.getResolvedPorts() {
+		m, err := parsePortMapping(p)
+		if err != nil {
+			continue
+		}
+		matched := port == "" || m.remote == port
+		if m.udp {
+			continue
+		}
+		if m.isUnix() {
+			if matched {
+				return "unix", m.unixPath(), nil
+			}
+			continue
+		}
+		if matched && f.target.ownListener() {
+			host := dialHost(f.addresses()[0])
+			return "tcp", net.JoinHostPort(host, m.local), nil
+		}
+		if matched && i < len(forwarded) {
+			host := dialHost(f.addresses()[0])
+			return "tcp", net.JoinHostPort(host, strconv.Itoa(int(forwarded[i].Local))), nil
+		}
+		i++
+	}
+	return "", "", fmt.Errorf("health check port %q is not forwarded", port)
 }
 
 func translatePorts(ports []string, svc *corev1.Service, pod *corev1.Pod) ([]string, error) {
 	var translated []string
 	for _, port := range ports {
-		var localPort, remotePort string
-
-		parts := strings.Split(port, ":")
-		if len(parts) == 1 {
-			localPort = parts[0]
-			remotePort = parts[0]
-		} else if len(parts) == 2 {
-			localPort = parts[0]
-			remotePort = parts[1]
-		} else {
-			return nil, fmt.Errorf("invalid port: %s", port)
+		m, err := parsePortMapping(port)
+		if err != nil {
+			return nil, err
 		}
 
-		portnum, err := strconv.Atoi(remotePort)
+		portnum, err := strconv.Atoi(m.remote)
 		if err != nil {
-			svcPort, err := util.LookupServicePortNumberByName(*svc, remotePort)
+			svcPort, err := util.LookupServicePortNumberByName(*svc, m.remote)
 			if err != nil {
 				return nil, err
 			}
 			portnum = int(svcPort)
 
-			if localPort == remotePort {
-				localPort = strconv.Itoa(portnum)
+			if m.local == m.remote {
+				m.local = strconv.Itoa(portnum)
 			}
 		}
 		containerPort, err := util.LookupContainerPortNumberByServicePort(*svc, *pod, int32(portnum))
@@ -233,12 +682,84 @@ func translatePorts(ports []string, svc *corev1.Service, pod *corev1.Pod) ([]str
 			return nil, err
 		}
 
-		remotePort = strconv.Itoa(int(containerPort))
-		if localPort != remotePort {
-			translated = append(translated, fmt.Sprintf("%s:%s", localPort, remotePort))
-		} else {
-			translated = append(translated, remotePort)
+		m.remote = strconv.Itoa(int(containerPort))
+		translated = append(translated, m.String())
+	}
+	return translated, nil
+}
+
+// translateContainerPorts resolves the named remote ports with the container ports of the pod.
+func translateContainerPorts(ports []string, pod *corev1.Pod, container string) ([]string, error) {
+	var containers []corev1.Container
+	for _, c := range pod.Spec.Containers {
+		if container == "" || c.Name == container {
+			containers = append(containers, c)
+		}
+	}
+	if len(containers) == 0 {
+		return nil, fmt.Errorf("container %s is not found in pod %s", container, pod.Name)
+	}
+
+	var translated []string
+	for _, port := range ports {
+		m, err := parsePortMapping(port)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := strconv.Atoi(m.remote); err == nil {
+			translated = append(translated, port)
+			continue
+		}
+
+		var portnum int32
+	CONTAINERS:
+		for _, c := range containers {
+			for _, p := range c.Ports {
+				if p.Name == m.remote {
+					portnum = p.ContainerPort
+					break CONTAINERS
+				}
+			}
+		}
+		if portnum == 0 {
+			return nil, fmt.Errorf("port %s is not found in pod %s", m.remote, pod.Name)
+		}
+
+		if m.local == m.remote {
+			m.local = strconv.Itoa(int(portnum))
 		}
+		m.remote = strconv.Itoa(int(portnum))
+		translated = append(translated, m.String())
 	}
 	return translated, nil
 }
+
+// expandAllPorts returns the mappings for all TCP ports declared by the Service or the containers of the pod.
+// "auto" maps them to allocated local ports, and "all" to the same local ports.
+func expandAllPorts(ports PortList, obj runtime.Object, pod *corev1.Pod, container string) []string {
+	prefix := ""
+	if len(ports) == 1 && ports[0] == portAuto {
+		prefix = portAuto + ":"
+	}
+
+	var expanded []string
+	if svc, ok := obj.(*corev1.Service); ok {
+		for _, p := range svc.Spec.Ports {
+			if p.Protocol == corev1.ProtocolTCP || p.Protocol == "" {
+				expanded = append(expanded, prefix+strconv.Itoa(int(p.Port)))
+			}
+		}
+		return expanded
+	}
+	for _, c := range pod.Spec.Containers {
+		if container != "" && c.Name != container {
+			continue
+		}
+		for _, p := range c.Ports {
+			if p.Protocol == corev1.ProtocolTCP || p.Protocol == "" {
+				expanded = append(expanded, prefix+strconv.Itoa(int(p.ContainerPort)))
+			}
+		}
+	}
+	return expanded
+}
@@ -0,0 +1,199 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// gatewayRoute is a host name routed by the gateway to the local port of a target.
+type gatewayRoute struct {
+	Host   string
+	Target string
+	State  ForwarderState
+	// Address is the local address of the target, which is empty until its ports are resolved.
+	Address string
+	TLS     bool
+}
+
+// gatewayServer is an HTTP server which routes the requests to the targets by the Host header,
+// and serves the list of the routes for the other hosts.
+type gatewayServer struct {
+	config GatewayConfig
+	routes func() []gatewayRoute
+	logger *zap.Logger
+
+	server *http.Server
+	proxy  *httputil.ReverseProxy
+	port   string
+	cancel context.CancelFunc
+}
+
+func newGatewayServer(config GatewayConfig, routes func() []gatewayRoute) *gatewayServer {
+	return &gatewayServer{
+		config: config,
+		routes: routes,
+		logger: zap.L().Named("gateway"),
+	}
+}
+
+type gatewayRouteKey struct{}
+
+func (s *gatewayServer) start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.config.Listen)
+	if err != nil {
+		return err
+	}
+	_, s.port, _ = net.SplitHostPort(listener.Addr().String())
+
+	s.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			route := r.In.Context().Value(gatewayRouteKey{}).(gatewayRoute)
+			r.Out.URL.Scheme = "http"
+			if route.TLS {
+				r.Out.URL.Scheme = "https"
+			}
+			r.Out.URL.Host = route.Address
+			r.SetXForwarded()
+		},
+		Transport: &http.Transport{
+			MaxIdleConns:    100,
+			IdleConnTimeout: 90 * time.Second,
+			// The certificate of a local TLS listener is not verified, because the connection does not leave the host.
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			s.logger.Debug("failed to forward request", zap.String("host", r.Host), zap.Error(err))
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		},
+	}
+	s.server = &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 30 * time.Second,
+		ErrorLog:          zap.NewStdLog(s.logger),
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+	go func() {
+		<-ctx.Done()
+		s.server.Close()
+	}()
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("gateway server stopped", zap.Error(err))
+		}
+	}()
+
+	s.logger.Info("start gateway server", zap.String("listen", listener.Addr().String()))
+	return nil
+}
+
+func (s *gatewayServer) stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+func (s *gatewayServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	routes := s.routes()
+	for _, route := range routes {
+		if route.Host != host {
+			continue
+		}
+		if route.Address == "" {
+			http.Error(w, fmt.Sprintf("%s is not forwarded: %s", route.Target, route.State), http.StatusServiceUnavailable)
+			return
+		}
+		s.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), gatewayRouteKey{}, route)))
+		return
+	}
+	s.index(w, r, routes)
+}
+
+var gatewayIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>kube-porter</title></head>
+<body>
+<h1>kube-porter</h1>
+<table>
+<tr><th>Host</th><th>Target</th><th>State</th></tr>
+{{- range .Routes}}
+<tr><td><a href="http://{{.Host}}:{{$.Port}}/">{{.Host}}</a></td><td>{{.Target}}</td><td>{{.State}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// index lists the routes of the gateway.
+func (s *gatewayServer) index(w http.ResponseWriter, r *http.Request, routes []gatewayRoute) {
+	status := http.StatusOK
+	if r.URL.Path != "/" {
+		status = http.StatusNotFound
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err := gatewayIndexTemplate.Execute(w, struct {
+		Routes []gatewayRoute
+		Port   string
+	}{routes, s.port})
+	if err != nil {
+		s.logger.Debug("failed to render index", zap.Error(err))
+	}
+}
+
+// gatewayHosts returns the host names routed to the target, which default to "<name>.localhost".
+func (t Target) gatewayHosts() []string {
+	if t.Gateway == nil {
+		return nil
+	}
+	if len(t.Gateway.Hosts) == 0 {
+		return []string{t.Name + ".localhost"}
+	}
+	hosts := make([]string, 0, len(t.Gateway.Hosts))
+	for _, h := range t.Gateway.Hosts {
+		hosts = append(hosts, strings.ToLower(h))
+	}
+	return hosts
+}
+
+// gatewayAddress returns the local address of the port routed by the gateway, or an empty string if it is not resolved yet.
+func (f *Forwarder) gatewayAddress() string {
+	for _, p := range f.getResolvedPorts() {
+		m, err := parsePortMapping(p)
+		if err != nil || m.udp || m.isUnix() || m.isAuto() {
+			continue
+		}
+		if f.target.Gateway.Port != "" && m.remote != f.target.Gateway.Port {
+			continue
+		}
+		return net.JoinHostPort(dialHost(f.addresses()[0]), m.local)
+	}
+	return ""
+}
+
+func sortGatewayRoutes(routes []gatewayRoute) {
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Host != routes[j].Host {
+			return routes[i].Host < routes[j].Host
+		}
+		return routes[i].Target < routes[j].Target
+	})
+}
@@ -0,0 +1,303 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	defaultHealthCheckInterval         = 10 * time.Second
+	defaultHealthCheckTimeout          = 1 * time.Second
+	defaultHealthCheckFailureThreshold = 3
+
+	// probeHeader marks the requests of the health checks, which the HTTP proxy does not log.
+	probeHeader = "X-Kube-Porter-Probe"
+)
+
+// probeToken is the value of probeHeader. It is random, so that clients cannot hide their requests from the log.
+var probeToken = newProbeToken()
+
+func newProbeToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (h *HealthCheck) interval() time.Duration {
+	if h.Interval.Duration > 0 {
+		return h.Interval.Duration
+	}
+	return defaultHealthCheckInterval
+}
+
+func (h *HealthCheck) timeout() time.Duration {
+	if h.Timeout.Duration > 0 {
+		return h.Timeout.Duration
+	}
+	return defaultHealthCheckTimeout
+}
+
+func (h *HealthCheck) failureThreshold() int {
+	if h.FailureThreshold > 0 {
+		return h.FailureThreshold
+	}
+	return defaultHealthCheckFailureThreshold
+}
+
+func (h *HealthCheck) port() string {
+	switch {
+	case h.HTTP != nil:
+		return h.HTTP.Port
+	case h.GRPC != nil:
+		return h.GRPC.Port
+	case h.TCP != nil:
+		return h.TCP.Port
+	}
+	return ""
+}
+
+// probesTunnel reports whether the health check is a TCP one, which probes the tunnel directly.
+// A local listener accepts connections even if the tunnel is dead, so connecting to it proves nothing.
+func (h *HealthCheck) probesTunnel() bool {
+	return h != nil && h.HTTP == nil && h.GRPC == nil
+}
+
+// probe checks the forwarded port listening on addr. The TCP probe opens a stream with remote instead.
+// If useTLS is true, the HTTP and gRPC probes handshake with the local TLS listener first.
+func (h *HealthCheck) probe(ctx context.Context, network, addr string, useTLS bool, remote func() (net.Conn, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout())
+	defer cancel()
+
+	dial := func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	host := addr
+	if network == "unix" {
+		host = "localhost"
+	}
+	// The certificate is not verified, because the probe checks the pod rather than the local listener.
+	dialTLS := func(proto string) func(context.Context) (net.Conn, error) {
+		if !useTLS {
+			return dial
+		}
+		return func(ctx context.Context) (net.Conn, error) {
+			conn, err := dial(ctx)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{proto}})
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		}
+	}
+
+	switch {
+	case h.HTTP != nil:
+		return probeHTTP(ctx, dialTLS("http/1.1"), host, h.HTTP)
+	case h.GRPC != nil:
+		return probeGRPC(ctx, dialTLS("h2"), host, h.GRPC)
+	default:
+		return probeTunnel(ctx, remote)
+	}
+}
+
+// probeTunnel opens a stream to the pod (or the remote host through the relay) with dial,
+// which returns after the other side has replied, and checks that the stream is not closed right away
+// because nothing listens on the port.
+func probeTunnel(ctx context.Context, dial func() (net.Conn, error)) error {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	dialed := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		dialed <- result{conn, err}
+	}()
+
+	var conn net.Conn
+	select {
+	case <-ctx.Done():
+		go func() {
+			if r := <-dialed; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return fmt.Errorf("no reply through the tunnel: %w", ctx.Err())
+	case r := <-dialed:
+		if r.err != nil {
+			return r.err
+		}
+		conn = r.conn
+	}
+	// Closing the connection unblocks the read.
+	defer conn.Close()
+
+	closed := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		closed <- err
+	}()
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-closed:
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("connection closed by remote: %w", err)
+	}
+}
+
+func probeHTTP(ctx context.Context, dial func(context.Context) (net.Conn, error), host string, hc *HTTPHealthCheck) error {
+	path := hc.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(probeHeader, probeToken)
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dial(ctx)
+			},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	if hc.ExpectedStatus != 0 {
+		if res.StatusCode != hc.ExpectedStatus {
+			return fmt.Errorf("unexpected status: %d", res.StatusCode)
+		}
+		return nil
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status: %d", res.StatusCode)
+	}
+	return nil
+}
+
+// probeGRPC calls grpc.health.v1.Health/Check over h2c.
+// The messages are tiny, so they are encoded by hand instead of depending on grpc-go.
+func probeGRPC(ctx context.Context, dial func(context.Context) (net.Conn, error), host string, hc *GRPCHealthCheck) error {
+	tr := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, _, _ string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx)
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	var msg []byte
+	if hc.Service != "" {
+		msg = append(msg, 0x0a)
+		msg = binary.AppendUvarint(msg, uint64(len(hc.Service)))
+		msg = append(msg, hc.Service...)
+	}
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	body = append(body, msg...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+host+"/grpc.health.v1.Health/Check", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set(probeHeader, probeToken)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	// A trailers-only response carries the status in the headers.
+	status := res.Trailer.Get("Grpc-Status")
+	message := res.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status = res.Header.Get("Grpc-Status")
+		message = res.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		return fmt.Errorf("grpc status %s: %s", status, message)
+	}
+	if len(b) < 5 || len(b) < 5+int(binary.BigEndian.Uint32(b[1:5])) {
+		return errors.New("malformed grpc response")
+	}
+
+	serving, err := parseServingStatus(b[5 : 5+binary.BigEndian.Uint32(b[1:5])])
+	if err != nil {
+		return err
+	}
+	if serving != 1 {
+		return fmt.Errorf("service is not serving: status=%d", serving)
+	}
+	return nil
+}
+
+// parseServingStatus extracts the status field (1) of a HealthCheckResponse.
+func parseServingStatus(b []byte) (uint64, error) {
+	var status uint64
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, errors.New("malformed grpc response")
+		}
+		b = b[n:]
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return 0, errors.New("malformed grpc response")
+			}
+			b = b[n:]
+			if key>>3 == 1 {
+				status = v
+			}
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return 0, errors.New("malformed grpc response")
+			}
+			b = b[n+int(l):]
+		default:
+			return 0, errors.New("malformed grpc response")
+		}
+	}
+	return status, nil
+}
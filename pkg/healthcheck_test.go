@@ -0,0 +1,34 @@
+package pkg
+
+import "testing"
+
+func TestParseServingStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		message []byte
+		want    uint64
+		wantErr bool
+	}{
+		{name: "empty means unknown", message: []byte{}, want: 0},
+		{name: "serving", message: []byte{0x08, 0x01}, want: 1},
+		{name: "not serving", message: []byte{0x08, 0x02}, want: 2},
+		{name: "unknown varint field is skipped", message: []byte{0x10, 0x05, 0x08, 0x01}, want: 1},
+		{name: "unknown bytes field is skipped", message: []byte{0x12, 0x02, 'a', 'b', 0x08, 0x01}, want: 1},
+		{name: "multi-byte varint", message: []byte{0x08, 0x80, 0x01}, want: 128},
+		{name: "truncated varint", message: []byte{0x08, 0x80}, wantErr: true},
+		{name: "truncated key", message: []byte{0x80}, wantErr: true},
+		{name: "bytes field overflows", message: []byte{0x12, 0x05, 'a'}, wantErr: true},
+		{name: "unsupported wire type", message: []byte{0x0d, 0, 0, 0, 0}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseServingStatus(tt.message)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseServingStatus() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("parseServingStatus() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package pkg
+
+import (
+	"bytes"
+	"os"
+	"strings"
+)
+
+const (
+	defaultHostsFile = "/etc/hosts"
+	hostsBlockBegin  = "# BEGIN kube-porter"
+	hostsBlockEnd    = "# END kube-porter"
+)
+
+// updateHostsFile replaces the kube-porter block in the hosts file with entries.
+// If entries is empty, the block is removed.
+func updateHostsFile(path string, entries []HostEntry) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	inBlock := false
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		switch strings.TrimSpace(line) {
+		case hostsBlockBegin:
+			inBlock = true
+			continue
+		case hostsBlockEnd:
+			inBlock = false
+			continue
+		}
+		if !inBlock && line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line)
+	}
+	if len(entries) > 0 {
+		if buf.Len() > 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+			buf.WriteString("\n")
+		}
+		buf.WriteString(hostsBlockBegin + "\n")
+		for _, e := range entries {
+			buf.WriteString(e.String() + "\n")
+		}
+		buf.WriteString(hostsBlockEnd + "\n")
+	}
+	if bytes.Equal(buf.Bytes(), b) {
+		return nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	// Write in place, since the directory of the hosts file is usually not writable.
+	return os.WriteFile(path, buf.Bytes(), fi.Mode().Perm())
+}
@@ -0,0 +1,109 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdateHostsFile(t *testing.T) {
+	entries := []HostEntry{
+		{IP: "127.0.1.2", Hostnames: []string{"web.default.svc.cluster.local", "web.default.svc"}},
+		{IP: "127.0.1.3", Hostnames: []string{"db.default.svc.cluster.local"}},
+	}
+	block := "# BEGIN kube-porter\n" +
+		"127.0.1.2 web.default.svc.cluster.local web.default.svc\n" +
+		"127.0.1.3 db.default.svc.cluster.local\n" +
+		"# END kube-porter\n"
+
+	tests := []struct {
+		name    string
+		content string
+		entries []HostEntry
+		want    string
+	}{
+		{
+			name:    "add block",
+			content: "127.0.0.1 localhost\n",
+			entries: entries,
+			want:    "127.0.0.1 localhost\n" + block,
+		},
+		{
+			name:    "add block without trailing newline",
+			content: "127.0.0.1 localhost",
+			entries: entries,
+			want:    "127.0.0.1 localhost\n" + block,
+		},
+		{
+			name:    "add block to empty file",
+			content: "",
+			entries: entries,
+			want:    block,
+		},
+		{
+			name:    "replace block",
+			content: "127.0.0.1 localhost\n# BEGIN kube-porter\n127.0.1.9 old.default.svc\n# END kube-porter\n::1 localhost\n",
+			entries: entries,
+			want:    "127.0.0.1 localhost\n::1 localhost\n" + block,
+		},
+		{
+			name:    "remove block",
+			content: "127.0.0.1 localhost\n" + block,
+			entries: nil,
+			want:    "127.0.0.1 localhost\n",
+		},
+		{
+			name:    "nothing to remove",
+			content: "127.0.0.1 localhost\n",
+			entries: nil,
+			want:    "127.0.0.1 localhost\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "hosts")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := updateHostsFile(path, tt.entries); err != nil {
+				t.Fatalf("updateHostsFile() error = %v", err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("hosts file = %q, want %q", got, tt.want)
+			}
+
+			// Applying the same entries again leaves the file as it is.
+			if err := updateHostsFile(path, tt.entries); err != nil {
+				t.Fatalf("updateHostsFile() error = %v", err)
+			}
+			again, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(again) != tt.want {
+				t.Errorf("hosts file after second update = %q, want %q", again, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateHostsFileKeepsMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte("127.0.0.1 localhost\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateHostsFile(path, []HostEntry{{IP: "127.0.1.2", Hostnames: []string{"web.default.svc"}}}); err != nil {
+		t.Fatalf("updateHostsFile() error = %v", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want %v", fi.Mode().Perm(), os.FileMode(0600))
+	}
+}
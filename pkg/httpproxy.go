@@ -0,0 +1,281 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	protocolTCP  = "tcp"
+	protocolHTTP = "http"
+
+	requestLogSize = 1000
+)
+
+// RequestLog is a request forwarded by a target whose protocol is "http".
+type RequestLog struct {
+	Time time.Time `json:"time"`
+	// Target is "<type>/<namespace>/<name>" of the target.
+	Target  string        `json:"target"`
+	Port    string        `json:"port"`
+	Proto   string        `json:"proto"`
+	Method  string        `json:"method"`
+	Host    string        `json:"host"`
+	Path    string        `json:"path"`
+	Status  int           `json:"status"`
+	Latency time.Duration `json:"latency"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// requestLog keeps the latest requests in a ring buffer.
+type requestLog struct {
+	mu      sync.Mutex
+	entries []RequestLog
+	next    int
+}
+
+func newRequestLog(size int) *requestLog {
+	return &requestLog{entries: make([]RequestLog, 0, size)}
+}
+
+func (l *requestLog) add(entry RequestLog) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) < cap(l.entries) {
+		l.entries = append(l.entries, entry)
+		return
+	}
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+}
+
+// list returns the requests of the targets in ids from the oldest one.
+func (l *requestLog) list(ids map[string]bool) []RequestLog {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := make([]RequestLog, 0, len(l.entries))
+	for i := range l.entries {
+		entry := l.entries[(l.next+i)%len(l.entries)]
+		if ids[entry.Target] {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// httpProxy forwards the HTTP requests received on a local port to the remote port, and logs each of them.
+type httpProxy struct {
+	target  string
+	port    string
+	logger  *zap.Logger
+	log     *requestLog
+	rewrite *HTTPRewrite
+	proxy   *httputil.ReverseProxy
+}
+
+// newHTTPProxy returns the proxy that forwards the requests through dial, over TLS if upstreamTLS is not nil.
+func (f *Forwarder) newHTTPProxy(m portMapping, dial func() (net.Conn, error), upstreamTLS *tls.Config) *httpProxy {
+	scheme := "http"
+	dial1, dial2 := dial, dial
+	if upstreamTLS != nil {
+		scheme = "https"
+		cfg1 := upstreamTLS.Clone()
+		cfg1.NextProtos = []string{"http/1.1"}
+		dial1 = dialTLS(dial, cfg1)
+		cfg2 := upstreamTLS.Clone()
+		cfg2.NextProtos = []string{http2.NextProtoTLS}
+		dial2 = dialTLS(dial, cfg2)
+	}
+	h1 := &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return dial1()
+		},
+		DialTLSContext: func(context.Context, string, string) (net.Conn, error) {
+			return dial1()
+		},
+		MaxIdleConns:    100,
+		IdleConnTimeout: 90 * time.Second,
+	}
+	// HTTP/2 requests received over h2c are forwarded with h2c (or h2 over TLS) as well (e.g. gRPC).
+	h2 := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(context.Context, string, string, *tls.Config) (net.Conn, error) {
+			return dial2()
+		},
+	}
+
+	p := &httpProxy{
+		target:  f.target.id(),
+		port:    m.remote,
+		logger:  f.logger.With(zap.String("port", m.remote)),
+		log:     f.requests,
+		rewrite: f.target.Rewrite,
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = scheme
+			r.Out.URL.Host = r.In.Host
+			if p.rewrite != nil {
+				p.rewrite.rewritePath(r.Out.URL)
+				if p.rewrite.Host != "" {
+					r.Out.URL.Host = p.rewrite.Host
+					r.Out.Host = p.rewrite.Host
+				}
+			}
+			if r.Out.URL.Host == "" {
+				r.Out.URL.Host = "localhost"
+			}
+		},
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			// Browsers negotiate HTTP/2 with the local TLS listener regardless of the pod,
+			// so only gRPC is forwarded with h2c in that case.
+			if r.ProtoMajor == 2 && (r.TLS == nil || isGRPC(r)) {
+				return h2.RoundTrip(r)
+			}
+			return h1.RoundTrip(r)
+		}),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if rec, ok := w.(*statusRecorder); ok {
+				rec.err = err
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	return p
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	// The health checks would push the requests of the user out of the log.
+	probe := r.Header.Get(probeHeader) == probeToken
+	r.Header.Del(probeHeader)
+	rec := &statusRecorder{ResponseWriter: w}
+	if err := p.serve(rec, r); err != nil {
+		rec.err = err
+		rec.WriteHeader(http.StatusBadGateway)
+	}
+	if probe {
+		return
+	}
+
+	entry := RequestLog{
+		Time:    start,
+		Target:  p.target,
+		Port:    p.port,
+		Proto:   r.Proto,
+		Method:  r.Method,
+		Host:    r.Host,
+		Path:    r.URL.RequestURI(),
+		Status:  rec.statusCode(),
+		Latency: time.Since(start),
+	}
+	if rec.err != nil && !errors.Is(rec.err, context.Canceled) {
+		entry.Error = rec.err.Error()
+	}
+	if p.log != nil {
+		p.log.add(entry)
+	}
+	p.logger.Info("request",
+		zap.String("proto", entry.Proto),
+		zap.String("method", entry.Method),
+		zap.String("host", entry.Host),
+		zap.String("path", entry.Path),
+		zap.Int("status", entry.Status),
+		zap.Duration("latency", entry.Latency),
+		zap.String("error", entry.Error),
+	)
+}
+
+// serve forwards the request with the headers of the rewrite rules.
+func (p *httpProxy) serve(w http.ResponseWriter, r *http.Request) error {
+	if p.rewrite != nil && len(p.rewrite.Headers) > 0 {
+		header, err := p.rewrite.headers()
+		if err != nil {
+			return err
+		}
+		r = r.Clone(r.Context())
+		for k, v := range header {
+			r.Header[k] = v
+		}
+	}
+	p.proxy.ServeHTTP(w, r)
+	return nil
+}
+
+// serveHTTP serves the HTTP/1.1 and h2c requests accepted by the listener until ctx is canceled.
+// If tlsConfig is not nil, it serves HTTPS and HTTP/2 over TLS instead.
+func (f *Forwarder) serveHTTP(ctx context.Context, l net.Listener, h http.Handler, tlsConfig *tls.Config) {
+	srv := &http.Server{
+		Handler:           h2c.NewHandler(h, &http2.Server{}),
+		ReadHeaderTimeout: 30 * time.Second,
+		ErrorLog:          zap.NewStdLog(f.logger),
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	var err error
+	if tlsConfig != nil {
+		srv.TLSConfig = tlsConfig
+		err = srv.ServeTLS(l, "", "")
+	} else {
+		err = srv.Serve(l)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) && ctx.Err() == nil {
+		f.logger.Debug("http server stopped", zap.String("local", l.Addr().String()), zap.Error(err))
+	}
+}
+
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// statusRecorder records the status code written by the handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	err    error
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 && status >= 200 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// Unwrap lets http.ResponseController flush the streamed responses.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
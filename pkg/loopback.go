@@ -0,0 +1,161 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime"
+	"sort"
+	"syscall"
+)
+
+const (
+	loopbackAuto         = "auto"
+	defaultLoopbackRange = "127.0.1.0/24"
+	clusterDomain        = "cluster.local"
+)
+
+// loopbackAllocator assigns a dedicated loopback address to each target that asks for one.
+type loopbackAllocator struct {
+	prefix    netip.Prefix
+	allocated map[string]netip.Addr
+	// fixed is the set of the targets whose address is fixed in the manifest.
+	fixed map[string]bool
+}
+
+func newLoopbackAllocator() *loopbackAllocator {
+	return &loopbackAllocator{
+		prefix:    netip.MustParsePrefix(defaultLoopbackRange),
+		allocated: make(map[string]netip.Addr),
+		fixed:     make(map[string]bool),
+	}
+}
+
+func (a *loopbackAllocator) setRange(cidr string) error {
+	if cidr == "" {
+		cidr = defaultLoopbackRange
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid loopbackRange: %w", err)
+	}
+	if !prefix.Addr().IsLoopback() {
+		return fmt.Errorf("invalid loopbackRange %s: not a loopback range", cidr)
+	}
+	prefix = prefix.Masked()
+	if prefix != a.prefix {
+		// Addresses outside of the new range are reallocated.
+		for id, addr := range a.allocated {
+			if !prefix.Contains(addr) {
+				delete(a.allocated, id)
+			}
+		}
+		a.prefix = prefix
+	}
+	return nil
+}
+
+// allocate returns the loopback address for the target id.
+// loopback is either "auto" or a fixed loopback IP address. A fixed address takes over the address
+// of an "auto" target, which gets another one when it is allocated next, so the fixed ones should be allocated first.
+func (a *loopbackAllocator) allocate(id string, loopback string) (string, error) {
+	if loopback != loopbackAuto {
+		addr, err := netip.ParseAddr(loopback)
+		if err != nil || !addr.IsLoopback() {
+			return "", fmt.Errorf("invalid loopback %q: must be %q or a loopback IP address", loopback, loopbackAuto)
+		}
+		for other, otherAddr := range a.allocated {
+			if other == id || otherAddr != addr {
+				continue
+			}
+			if a.fixed[other] {
+				return "", fmt.Errorf("loopback %s is already used by %s", addr, other)
+			}
+			delete(a.allocated, other)
+		}
+		a.allocated[id] = addr
+		a.fixed[id] = true
+		return addr.String(), nil
+	}
+	delete(a.fixed, id)
+
+	if addr, ok := a.allocated[id]; ok && a.prefix.Contains(addr) {
+		return addr.String(), nil
+	}
+	used := make(map[netip.Addr]bool, len(a.allocated))
+	for _, addr := range a.allocated {
+		used[addr] = true
+	}
+	// Skip the network address and the next one, which is commonly used for the hostname (127.0.1.1).
+	addr := a.prefix.Addr().Next().Next()
+	for ; a.prefix.Contains(addr); addr = addr.Next() {
+		if !used[addr] {
+			a.allocated[id] = addr
+			return addr.String(), nil
+		}
+	}
+	return "", errors.New("no loopback address is available in " + a.prefix.String())
+}
+
+// retain releases the addresses of the targets that are not in ids, and the fixed ones,
+// which are reserved again from the manifest.
+func (a *loopbackAllocator) retain(ids map[string]bool) {
+	for id := range a.allocated {
+		if !ids[id] || a.fixed[id] {
+			delete(a.allocated, id)
+			delete(a.fixed, id)
+		}
+	}
+}
+
+// HostEntry is a line of a hosts file that maps the names of a forwarded Service to its loopback address.
+type HostEntry struct {
+	IP        string   `json:"ip"`
+	Hostnames []string `json:"hostnames"`
+}
+
+func (e HostEntry) String() string {
+	s := e.IP
+	for _, h := range e.Hostnames {
+		s += " " + h
+	}
+	return s
+}
+
+// serviceHostnames returns the in-cluster DNS names of a Service target.
+// "<name>.<namespace>" is left out, because it can shadow a public name (e.g. Service "api" in namespace "io").
+func (t Target) serviceHostnames() []string {
+	if t.ObjectType != "Service" {
+		return nil
+	}
+	return []string{
+		fmt.Sprintf("%s.%s.svc.%s", t.Name, t.Namespace, clusterDomain),
+		fmt.Sprintf("%s.%s.svc", t.Name, t.Namespace),
+	}
+}
+
+func sortHostEntries(entries []HostEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		a, _ := netip.ParseAddr(entries[i].IP)
+		b, _ := netip.ParseAddr(entries[j].IP)
+		return a.Less(b)
+	})
+}
+
+// checkLoopback reports a loopback address that is not assigned to the host,
+// which is the case for the ones other than 127.0.0.1 on macOS until they are added to lo0.
+func checkLoopback(ip string) error {
+	l, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	if err == nil {
+		l.Close()
+		return nil
+	}
+	if !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return nil
+	}
+	if runtime.GOOS == "darwin" {
+		return fmt.Errorf("loopback %s is not configured; add it with \"sudo ifconfig lo0 alias %s up\" and save the manifest to retry", ip, ip)
+	}
+	return fmt.Errorf("loopback %s is not configured on this host; add it and save the manifest to retry", ip)
+}
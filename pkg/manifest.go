@@ -1,10 +1,13 @@
 package pkg
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
 	"os"
 	"strings"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/yaml"
 )
 
@@ -12,15 +15,266 @@ type Target struct {
 	ObjectType string   `json:"type"`
 	Namespace  string   `json:"namespace"`
 	Name       string   `json:"name"`
-	Ports      []string `json:"ports"`
+	Ports      PortList `json:"ports"`
+	// Host is the address ("<host>" or "<host>:<port>") connected to by a Remote target.
+	// The relay pod runs in Namespace and Name only identifies the target.
+	// The port of Host is forwarded if Ports is omitted.
+	Host string `json:"host,omitempty"`
+	// Container selects the container whose named ports are used to resolve Ports.
+	// If it is empty, all containers of the pod are searched.
+	Container string   `json:"container,omitempty"`
+	Address   []string `json:"address,omitempty"`
+	// Loopback is "auto" or a loopback IP address to listen on instead of Address,
+	// so that the target can use its original ports without clashing with other targets.
+	Loopback string `json:"loopback,omitempty"`
+	// Protocol is "tcp" (default) or "http". "http" makes the local listener parse HTTP/1.1 and h2c
+	// requests to log each of them.
+	Protocol string `json:"protocol,omitempty"`
+	// TLS terminates TLS on the local listener, and the plaintext is forwarded to the pod.
+	TLS         *TLSConfig   `json:"tls,omitempty"`
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty"`
+	Retry       *RetryPolicy `json:"retry,omitempty"`
+	// Relay configures the helper pod which relays UDP ports ("53/udp") and Remote hosts.
+	Relay *RelayConfig `json:"relay,omitempty"`
+	// UpstreamTLS makes kube-porter connect to the pod with TLS, so that the local listener can speak plaintext.
+	UpstreamTLS *UpstreamTLSConfig `json:"upstreamTLS,omitempty"`
+	// Rewrite modifies the requests of a target whose protocol is "http" before they are forwarded.
+	Rewrite *HTTPRewrite `json:"rewrite,omitempty"`
+	// Gateway routes the requests to the gateway for its host names to the target.
+	Gateway *TargetGateway `json:"gateway,omitempty"`
+	// Transport is the protocol of port-forward: "auto" (default), "websocket" or "spdy".
+	Transport string `json:"transport,omitempty"`
+	// AllowNotReady lets the target forward to a pod that is not ready (e.g. to debug a failing probe).
+	// By default, only pods whose Container (or all containers) are ready are selected.
+	AllowNotReady bool `json:"allowNotReady,omitempty"`
+}
+
+const (
+	transportAuto      = "auto"
+	transportWebSocket = "websocket"
+	transportSPDY      = "spdy"
+)
+
+// PortList is the list of port mappings of a target.
+// It can also be "all" (or omitted) to forward every declared port to the same local port,
+// or "auto" to forward every declared port to an allocated local port.
+type PortList []string
+
+func (p *PortList) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		if s != portAll && s != portAuto {
+			return fmt.Errorf("invalid ports: %s", s)
+		}
+		*p = PortList{s}
+		return nil
+	}
+	var ports []string
+	if err := json.Unmarshal(b, &ports); err != nil {
+		return err
+	}
+	*p = ports
+	return nil
+}
+
+func (p PortList) isAll() bool {
+	return len(p) == 0 || (len(p) == 1 && (p[0] == portAll || p[0] == portAuto))
+}
+
+// id identifies the Kubernetes object regardless of the forwarded ports.
+func (t Target) id() string {
+	return fmt.Sprintf("%s/%s/%s", t.ObjectType, t.Namespace, t.Name)
+}
+
+// matches reports whether the target is specified by s, which is
+// "<name>", "<namespace>/<name>" or "<type>/<namespace>/<name>".
+func (t Target) matches(s string) bool {
+	parts := strings.Split(s, "/")
+	switch len(parts) {
+	case 1:
+		return t.Name == parts[0]
+	case 2:
+		return t.Namespace == parts[0] && t.Name == parts[1]
+	case 3:
+		return strings.EqualFold(t.ObjectType, parts[0]) && t.Namespace == parts[1] && t.Name == parts[2]
+	}
+	return false
+}
+
+// ownListener reports whether the TCP ports are served by the listeners of kube-porter instead of client-go,
+// which is needed to relay, parse or encrypt the connections, or to probe the tunnel with a TCP health check.
+func (t Target) ownListener() bool {
+	return t.ObjectType == "Remote" || t.Protocol == protocolHTTP || t.TLS != nil || t.UpstreamTLS != nil || t.HealthCheck.probesTunnel()
+}
+
+// remoteHost returns the host part of Host.
+func (t Target) remoteHost() string {
+	if host, _, err := net.SplitHostPort(t.Host); err == nil {
+		return host
+	}
+	return strings.Trim(t.Host, "[]")
+}
+
+// remotePorts returns the mapping for the port of Host, used when Ports is "all", "auto" or omitted.
+func (t Target) remotePorts() ([]string, error) {
+	_, port, err := net.SplitHostPort(t.Host)
+	if err != nil {
+		return nil, fmt.Errorf("ports must be specified unless host %q has a port", t.Host)
+	}
+	if len(t.Ports) == 1 && t.Ports[0] == portAuto {
+		return []string{portAuto + ":" + port}, nil
+	}
+	return []string{port}, nil
 }
 
 func (t Target) String() string {
 	return fmt.Sprintf("%s:%s/%s(%s)", t.ObjectType, t.Namespace, t.Name, strings.Join(t.Ports, ","))
 }
 
+// HealthCheck probes a forwarded port through the tunnel.
+// Exactly one of TCP, HTTP and GRPC should be set, and TCP is used if none is.
+type HealthCheck struct {
+	Interval         metav1.Duration `json:"interval,omitempty"`
+	Timeout          metav1.Duration `json:"timeout,omitempty"`
+	FailureThreshold int             `json:"failureThreshold,omitempty"`
+
+	TCP  *TCPHealthCheck  `json:"tcp,omitempty"`
+	HTTP *HTTPHealthCheck `json:"http,omitempty"`
+	GRPC *GRPCHealthCheck `json:"grpc,omitempty"`
+}
+
+// Port is the remote side of one of the target's port mappings (e.g. "80" or "http").
+// If it is empty, the first mapping is probed.
+type TCPHealthCheck struct {
+	Port string `json:"port,omitempty"`
+}
+
+type HTTPHealthCheck struct {
+	Port           string `json:"port,omitempty"`
+	Path           string `json:"path,omitempty"`
+	ExpectedStatus int    `json:"expectedStatus,omitempty"`
+}
+
+type GRPCHealthCheck struct {
+	Port    string `json:"port,omitempty"`
+	Service string `json:"service,omitempty"`
+}
+
+// RelayConfig configures the helper pods that kube-porter runs in the cluster.
+type RelayConfig struct {
+	// Image is the container image of kube-porter, which defaults to the one of the running version.
+	// The image must have the kube-porter binary at /usr/local/bin/kube-porter.
+	Image string `json:"image,omitempty"`
+}
+
+// TLSConfig configures the certificate of a local TLS listener.
+// If CertFile and KeyFile are empty, a certificate for the requested host name is issued by
+// the local CA of kube-porter, which can be exported with "kube-porter ca export".
+// The local CA only issues certificates for localhost and its subdomains, loopback addresses,
+// "*.svc", "*.cluster.local" and the gateway host names configured when it was created.
+type TLSConfig struct {
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+}
+
+// UpstreamTLSConfig configures the TLS connections to the pod.
+type UpstreamTLSConfig struct {
+	// ServerName is sent as SNI and verified against the certificate of the pod.
+	// It defaults to the host of a Remote target, and to "<name>.<namespace>.svc" otherwise.
+	ServerName string `json:"serverName,omitempty"`
+	// CAFile is the PEM file of the CAs to verify the certificate with, instead of the system ones.
+	CAFile             string `json:"caFile,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+// HTTPRewrite is applied in the order of StripPrefix, AddPrefix, Host and Headers.
+type HTTPRewrite struct {
+	// Host replaces the Host header (e.g. the host name that an ingress routes by).
+	Host        string `json:"host,omitempty"`
+	StripPrefix string `json:"stripPrefix,omitempty"`
+	AddPrefix   string `json:"addPrefix,omitempty"`
+	// Headers are set on every request, replacing the ones sent by the client.
+	Headers []HeaderRewrite `json:"headers,omitempty"`
+}
+
+// HeaderRewrite sets a header to Value, the content of File or the environment variable Env.
+// File and Env are read for each request, so that a rotated token is picked up.
+type HeaderRewrite struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+	File  string `json:"file,omitempty"`
+	Env   string `json:"env,omitempty"`
+}
+
+// TargetGateway is the route of a target in the gateway.
+type TargetGateway struct {
+	// Hosts are the host names routed to the target, which default to "<name>.localhost".
+	Hosts []string `json:"hosts,omitempty"`
+	// Port is the remote side of the port mapping to route to, which defaults to the first TCP one.
+	Port string `json:"port,omitempty"`
+}
+
+// RetryPolicy controls how a forwarder reconnects after a failure.
+// Unset fields of a target's policy are taken from the manifest-wide policy.
+type RetryPolicy struct {
+	Initial    metav1.Duration `json:"initial,omitempty"`
+	Max        metav1.Duration `json:"max,omitempty"`
+	Multiplier float64         `json:"multiplier,omitempty"`
+	// Jitter randomizes each delay by up to this fraction of it (e.g. 0.2 = ±20%).
+	Jitter float64 `json:"jitter,omitempty"`
+	// MaxFailures is the number of consecutive failures after which the forwarder gives up.
+	// Zero means it retries forever.
+	MaxFailures int `json:"maxFailures,omitempty"`
+}
+
 type Manifest struct {
-	Targets []Target `json:"targets"`
+	// Address is the list of local addresses to listen on (e.g. "localhost", "0.0.0.0", "::1").
+	Address []string `json:"address,omitempty"`
+	// Loopback is the default of Target.Loopback.
+	Loopback string `json:"loopback,omitempty"`
+	// LoopbackRange is the CIDR from which "auto" loopback addresses are allocated.
+	LoopbackRange string       `json:"loopbackRange,omitempty"`
+	Retry         *RetryPolicy `json:"retry,omitempty"`
+	Relay         *RelayConfig `json:"relay,omitempty"`
+	DNS           *DNSConfig   `json:"dns,omitempty"`
+	Proxy         *ProxyConfig `json:"proxy,omitempty"`
+	Targets       []Target     `json:"targets"`
+	// Reverse is the list of Services to create in the cluster, whose connections are forwarded
+	// to the local ports of the port mappings ("<local>:<service port>") through a relay pod.
+	Reverse []Target `json:"reverse,omitempty"`
+	// Gateway enables the HTTP server which routes the requests to the targets by the Host header.
+	Gateway *GatewayConfig `json:"gateway,omitempty"`
+	// Transport is the default of Target.Transport, which is also used by the proxy.
+	Transport string `json:"transport,omitempty"`
+}
+
+// DNSConfig enables the embedded DNS server, which resolves the names of forwarded Services
+// (<name>.<namespace>.svc.cluster.local) to their dedicated loopback addresses.
+type DNSConfig struct {
+	Listen string `json:"listen"`
+	// Upstream is the server to which other queries are relayed.
+	// It defaults to the first nameserver in /etc/resolv.conf other than kube-porter itself.
+	Upstream string `json:"upstream,omitempty"`
+}
+
+// ProxyConfig enables the SOCKS5 and HTTP proxy, which connects to any Service or pod of the cluster
+// (e.g. "web.default.svc.cluster.local:80") through port-forward without a target.
+type ProxyConfig struct {
+	// Listen is the address of the proxy (e.g. "localhost:1080"), which serves both protocols.
+	Listen string `json:"listen"`
+	// PodCIDRs are the address ranges of the pods. The destinations in them are looked up as pods,
+	// and the others are outside of the cluster. They default to the private address ranges.
+	PodCIDRs []string `json:"podCIDRs,omitempty"`
+	// AllowDirect allows the destinations outside of the cluster, which are connected directly from the local host.
+	// Otherwise, they are rejected so that the proxy cannot be used to reach arbitrary hosts.
+	AllowDirect bool `json:"allowDirect,omitempty"`
+}
+
+// GatewayConfig enables the HTTP gateway, which routes the requests for the host names of the targets
+// (e.g. "grafana.localhost") to their local ports, and lists the routes for the other host names.
+type GatewayConfig struct {
+	// Listen is the address of the gateway (e.g. "localhost:8000").
+	Listen string `json:"listen"`
 }
 
 func LoadManifest(filepath string) (*Manifest, error) {
@@ -33,5 +287,29 @@ func LoadManifest(filepath string) (*Manifest, error) {
 	if err != nil {
 		return nil, err
 	}
+	cfg.applyDefaults()
 	return cfg, nil
 }
+
+// applyDefaults fills the per-target settings with the manifest-wide ones.
+func (m *Manifest) applyDefaults() {
+	for _, t := range m.Reverse {
+		t.ObjectType = "Reverse"
+		m.Targets = append(m.Targets, t)
+	}
+	for i := range m.Targets {
+		if len(m.Targets[i].Address) == 0 {
+			m.Targets[i].Address = m.Address
+		}
+		if m.Targets[i].Loopback == "" {
+			m.Targets[i].Loopback = m.Loopback
+		}
+		m.Targets[i].Retry = m.Retry.merge(m.Targets[i].Retry)
+		if m.Targets[i].Relay == nil {
+			m.Targets[i].Relay = m.Relay
+		}
+		if m.Targets[i].Transport == "" {
+			m.Targets[i].Transport = m.Transport
+		}
+	}
+}
@@ -2,7 +2,15 @@ package pkg
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/fsnotify/fsnotify"
@@ -10,27 +18,56 @@ import (
 )
 
 type manifestReconciler struct {
-	kubeconfig string
-	manifest   string
-	logger     *zap.Logger
+	kubeconfig       string
+	manifest         string
+	stateDir         string
+	allowNonLoopback bool
+	hostsFilePath    string
+	api              APIOptions
+	logger           *zap.Logger
 
 	mu         sync.RWMutex
 	forwarders map[string]*Forwarder
+	loopbacks  *loopbackAllocator
+	ports      *portAllocator
+	dns        *dnsServer
+	proxy      *proxyServer
+	gateway    *gatewayServer
+	requests   *requestLog
+	ca         *localCA
+	// hostsFile is the hosts file kept in sync with the forwarded Services. It is empty unless enabled.
+	hostsFile string
 }
 
-func newManifestReconciler(kubeconfig string, manifest string) *manifestReconciler {
+func newManifestReconciler(opts ServerOptions) *manifestReconciler {
 	return &manifestReconciler{
-		kubeconfig: kubeconfig,
-		manifest:   manifest,
-		logger:     zap.L().Named("manifest-reconciler"),
+		kubeconfig:       opts.Kubeconfig,
+		manifest:         opts.Manifest,
+		stateDir:         opts.StateDir,
+		allowNonLoopback: opts.AllowNonLoopback,
+		hostsFilePath:    opts.HostsFile,
+		api:              opts.API,
+		logger:           zap.L().Named("manifest-reconciler"),
 
 		mu:         sync.RWMutex{},
 		forwarders: make(map[string]*Forwarder),
+		loopbacks:  newLoopbackAllocator(),
+		requests:   newRequestLog(requestLogSize),
+		ca:         newLocalCA(opts.StateDir),
 	}
 }
 
-func (r manifestReconciler) run(ctx context.Context) error {
-	err := r.reconcile(ctx)
+func (r *manifestReconciler) run(ctx context.Context) error {
+	defer r.cleanup()
+
+	ports, err := newPortAllocator(filepath.Join(r.stateDir, "ports.json"))
+	if err != nil {
+		return err
+	}
+	r.ports = ports
+	r.deleteStaleRelayPods(ctx)
+
+	err = r.reconcile(ctx)
 	if err != nil {
 		return err
 	}
@@ -56,7 +93,7 @@ func (r manifestReconciler) run(ctx context.Context) error {
 	}
 }
 
-func (r manifestReconciler) reconcile(ctx context.Context) error {
+func (r *manifestReconciler) reconcile(ctx context.Context) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -64,41 +101,385 @@ func (r manifestReconciler) reconcile(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	loopbacks, loopbackErrs, err := r.allocateLoopbacks(cfg)
+	if err != nil {
+		return err
+	}
+	blocked := r.blockedTargets(cfg, loopbacks, loopbackErrs)
+
+	ids := make(map[string]bool)
+	for _, target := range cfg.Targets {
+		ids[target.id()] = true
+	}
+	if err := r.ports.retain(ids); err != nil {
+		r.logger.Error("failed to release ports", zap.Error(err))
+	}
 
+	var gatewayHosts []string
+	for _, target := range cfg.Targets {
+		gatewayHosts = append(gatewayHosts, target.gatewayHosts()...)
+	}
+	r.ca.setHosts(gatewayHosts)
+	for _, host := range r.ca.unpermittedHosts(gatewayHosts) {
+		r.logger.Warn("the local CA cannot issue certificates for the gateway host; remove ca.crt and ca.key from the state directory to recreate it, and trust it again",
+			zap.String("host", host), zap.String("dir", r.stateDir))
+	}
+
+	var stopped []*Forwarder
 OUTER:
 	for k, f := range r.forwarders {
 		for _, target := range cfg.Targets {
-			if k == target.String() {
+			if k == target.String() && reflect.DeepEqual(f.target, target) && f.loopback == loopbacks[k] && blockedMessage(f.blocked) == blockedMessage(blocked[k]) {
 				continue OUTER
 			}
 		}
 		f.Stop()
 		delete(r.forwarders, k)
+		stopped = append(stopped, f)
+	}
+	// A replacement uses the same ports and relay pod, so it must not start before the old one has
+	// closed its listeners and deleted its relay pod.
+	for _, f := range stopped {
+		f.Wait()
 	}
 
 	for _, target := range cfg.Targets {
 		if _, ok := r.forwarders[target.String()]; ok {
 			continue
 		}
-		f, err := NewForwarder(r.kubeconfig, target)
+		f, err := NewForwarder(r.kubeconfig, r.api, target)
 		if err != nil {
 			return err
 		}
-		f.Run(ctx)
+		f.loopback = loopbacks[target.String()]
+		f.allocator = r.ports
+		f.requests = r.requests
+		f.ca = r.ca
+		if err := blocked[target.String()]; err != nil {
+			r.logger.Error("cannot start forwarder", zap.String("target", target.String()), zap.Error(err))
+			f.blocked = err
+			f.setState(err.state, err.Error())
+		} else {
+			f.Run(ctx)
+		}
 		r.forwarders[target.String()] = f
 	}
+
+	r.reconcileDNS(ctx, cfg.DNS)
+	r.reconcileProxy(ctx, cfg.Proxy, cfg.Transport)
+	r.reconcileGateway(ctx, cfg.Gateway)
+	r.syncHostsFile()
 	return nil
 }
 
-func (r manifestReconciler) Status() []ForwarderStatus {
+func (r *manifestReconciler) cleanup() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// The forwarders are waited for, so that their relay pods are deleted before the daemon exits.
+	for _, f := range r.forwarders {
+		f.Stop()
+	}
+	for _, f := range r.forwarders {
+		f.Wait()
+	}
+
+	if r.hostsFile != "" {
+		if err := updateHostsFile(r.hostsFile, nil); err != nil {
+			r.logger.Error("failed to clean up hosts file", zap.String("file", r.hostsFile), zap.Error(err))
+		}
+	}
+}
+
+// deleteStaleRelayPods deletes the relay pods left by a previous daemon on this host that did not stop cleanly,
+// in the namespaces of the targets.
+func (r *manifestReconciler) deleteStaleRelayPods(ctx context.Context) {
+	cfg, err := LoadManifest(r.manifest)
+	if err != nil {
+		return
+	}
+	namespaces := make(map[string]bool)
+	for _, t := range cfg.Targets {
+		if t.needsRelay() {
+			namespaces[t.Namespace] = true
+		}
+	}
+	if len(namespaces) == 0 {
+		return
+	}
+	config, _, err := newRESTClient(r.kubeconfig, r.api)
+	if err != nil {
+		r.logger.Error("failed to delete stale relay pods", zap.Error(err))
+		return
+	}
+	for ns := range namespaces {
+		if err := deleteStaleRelayPods(ctx, config, ns); err != nil {
+			r.logger.Warn("failed to delete stale relay pods", zap.String("namespace", ns), zap.Error(err))
+		}
+	}
+}
+
+func (r *manifestReconciler) syncHostsFile() {
+	if r.hostsFile == "" {
+		return
+	}
+	if err := updateHostsFile(r.hostsFile, r.hostEntries()); err != nil {
+		r.logger.Error("failed to update hosts file", zap.String("file", r.hostsFile), zap.Error(err))
+	}
+}
+
+// ApplyHostsFile writes the entries of the forwarded Services to the hosts file
+// and keeps them in sync until RemoveHostsFile is called.
+// The path is fixed when the daemon starts, so that clients of the socket cannot make it rewrite other files.
+func (r *manifestReconciler) ApplyHostsFile() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	path := r.hostsFilePath
+	if path == "" {
+		path = defaultHostsFile
+	}
+	if err := updateHostsFile(path, r.hostEntries()); err != nil {
+		return err
+	}
+	r.hostsFile = path
+	return nil
+}
+
+func (r *manifestReconciler) RemoveHostsFile() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.hostsFile == "" {
+		return nil
+	}
+	if err := updateHostsFile(r.hostsFile, nil); err != nil {
+		return err
+	}
+	r.hostsFile = ""
+	return nil
+}
+
+// reconcileDNS restarts the DNS server when its configuration has changed.
+// A DNS server that fails to start does not stop the forwarders.
+func (r *manifestReconciler) reconcileDNS(ctx context.Context, config *DNSConfig) {
+	if r.dns != nil {
+		if config != nil && r.dns.config == *config {
+			return
+		}
+		r.dns.stop()
+		r.dns = nil
+	}
+	if config == nil {
+		return
+	}
+	host, _, err := net.SplitHostPort(config.Listen)
+	if err == nil {
+		err = validateAddresses([]string{host}, r.allowNonLoopback)
+	}
+	if err != nil {
+		r.logger.Error("invalid dns address", zap.String("listen", config.Listen), zap.Error(err))
+		return
+	}
+	dns := newDNSServer(*config, r.lookupHost)
+	if err := dns.start(ctx); err != nil {
+		r.logger.Error("failed to start dns server", zap.Error(err))
+		return
+	}
+	r.dns = dns
+}
+
+func (r *manifestReconciler) reconcileProxy(ctx context.Context, config *ProxyConfig, transport string) {
+	if r.proxy != nil {
+		if config != nil && reflect.DeepEqual(r.proxy.config, *config) && r.proxy.transport == transport {
+			return
+		}
+		r.proxy.stop()
+		r.proxy = nil
+	}
+	if config == nil {
+		return
+	}
+	host, _, err := net.SplitHostPort(config.Listen)
+	if err == nil {
+		err = validateAddresses([]string{host}, r.allowNonLoopback)
+	}
+	if err != nil {
+		r.logger.Error("invalid proxy address", zap.String("listen", config.Listen), zap.Error(err))
+		return
+	}
+	proxy := newProxyServer(*config, r.kubeconfig, r.api, transport)
+	if err := proxy.start(ctx); err != nil {
+		r.logger.Error("failed to start proxy server", zap.Error(err))
+		return
+	}
+	r.proxy = proxy
+}
+
+func (r *manifestReconciler) reconcileGateway(ctx context.Context, config *GatewayConfig) {
+	if r.gateway != nil {
+		if config != nil && r.gateway.config == *config {
+			return
+		}
+		r.gateway.stop()
+		r.gateway = nil
+	}
+	if config == nil {
+		return
+	}
+	host, _, err := net.SplitHostPort(config.Listen)
+	if err == nil {
+		err = validateAddresses([]string{host}, r.allowNonLoopback)
+	}
+	if err != nil {
+		r.logger.Error("invalid gateway address", zap.String("listen", config.Listen), zap.Error(err))
+		return
+	}
+	gateway := newGatewayServer(*config, r.gatewayRoutes)
+	if err := gateway.start(ctx); err != nil {
+		r.logger.Error("failed to start gateway server", zap.Error(err))
+		return
+	}
+	r.gateway = gateway
+}
+
+// gatewayRoutes returns the routes of the targets with gateway host names.
+func (r *manifestReconciler) gatewayRoutes() []gatewayRoute {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var routes []gatewayRoute
+	for _, forwarder := range r.forwarders {
+		if forwarder.target.ObjectType == "Reverse" {
+			continue
+		}
+		state, _ := forwarder.getState()
+		for _, host := range forwarder.target.gatewayHosts() {
+			route := gatewayRoute{
+				Host:   host,
+				Target: forwarder.target.id(),
+				State:  state,
+				TLS:    forwarder.target.TLS != nil,
+			}
+			if state == StateForwarding {
+				route.Address = forwarder.gatewayAddress()
+			}
+			routes = append(routes, route)
+		}
+	}
+	sortGatewayRoutes(routes)
+	return routes
+}
+
+// lookupHost returns the loopback address of the forwarded Service named name.
+func (r *manifestReconciler) lookupHost(name string) (netip.Addr, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, forwarder := range r.forwarders {
+		if forwarder.loopback == "" {
+			continue
+		}
+		for _, hostname := range forwarder.target.serviceHostnames() {
+			if hostname == name {
+				addr, err := netip.ParseAddr(forwarder.loopback)
+				return addr, err == nil
+			}
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// blockedTargets returns the reason why each target cannot be started, keyed by Target.String().
+func (r *manifestReconciler) blockedTargets(cfg *Manifest, loopbacks map[string]string, loopbackErrs map[string]error) map[string]*stateError {
+	blocked := make(map[string]*stateError)
+	var targets []Target
+	addresses := make(map[string][]string)
+	for _, target := range cfg.Targets {
+		key := target.String()
+		if err := loopbackErrs[key]; err != nil {
+			blocked[key] = &stateError{state: StateFailed, err: err}
+			continue
+		}
+		addresses[key] = listenAddresses(target, loopbacks[key])
+		if err := validateAddresses(addresses[key], r.allowNonLoopback); err != nil {
+			blocked[key] = &stateError{state: StateFailed, err: err}
+			continue
+		}
+		targets = append(targets, target)
+	}
+
+	// Running forwarders keep their ports.
+	running := make(map[string]bool)
+	for k, f := range r.forwarders {
+		running[k] = f.blocked == nil
+	}
+	for key, err := range findPortConflicts(targets, addresses, running) {
+		blocked[key] = &stateError{state: StatePortConflict, err: err}
+	}
+	return blocked
+}
+
+func blockedMessage(err *stateError) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// allocateLoopbacks assigns loopback addresses to the targets, keyed by Target.String().
+// Fixed addresses are reserved before "auto" ones are allocated.
+func (r *manifestReconciler) allocateLoopbacks(cfg *Manifest) (map[string]string, map[string]error, error) {
+	if err := r.loopbacks.setRange(cfg.LoopbackRange); err != nil {
+		return nil, nil, err
+	}
+	ids := make(map[string]bool)
+	for _, target := range cfg.Targets {
+		if target.Loopback != "" {
+			ids[target.id()] = true
+		}
+	}
+	r.loopbacks.retain(ids)
+
+	loopbacks := make(map[string]string)
+	errs := make(map[string]error)
+	for _, auto := range []bool{false, true} {
+		for _, target := range cfg.Targets {
+			if target.Loopback == "" || (target.Loopback == loopbackAuto) != auto {
+				continue
+			}
+			ip, err := r.loopbacks.allocate(target.id(), target.Loopback)
+			if err == nil {
+				// Retrying cannot help until the address is configured.
+				err = checkLoopback(ip)
+			}
+			if err != nil {
+				errs[target.String()] = err
+				continue
+			}
+			loopbacks[target.String()] = ip
+		}
+	}
+	return loopbacks, errs, nil
+}
+
+func (r *manifestReconciler) Status() []ForwarderStatus {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
 	var forwarderList []ForwarderStatus
 	for _, forwarder := range r.forwarders {
+		state, message := forwarder.getState()
 		forwarderList = append(forwarderList, ForwarderStatus{
-			Target:     forwarder.target,
-			Forwarding: forwarder.isForwarding(),
+			Target:        forwarder.target,
+			Forwarding:    state == StateForwarding,
+			State:         state,
+			Message:       message,
+			Loopback:      forwarder.loopback,
+			ResolvedPorts: forwarder.getResolvedPorts(),
+			Pod:           forwarder.getPodStatus(),
+			Events:        forwarder.getEvents(),
 		})
 	}
 	sort.Slice(forwarderList, func(i, j int) bool {
@@ -106,3 +487,79 @@ func (r manifestReconciler) Status() []ForwarderStatus {
 	})
 	return forwarderList
 }
+
+// LookupPort returns the local port forwarded to the remote port of the target.
+// target is "<name>", "<namespace>/<name>" or "<type>/<namespace>/<name>".
+func (r *manifestReconciler) LookupPort(target string, remote string) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var found []int
+	for _, forwarder := range r.forwarders {
+		if !forwarder.target.matches(target) {
+			continue
+		}
+		for _, port := range forwarder.getResolvedPorts() {
+			m, err := parsePortMapping(port)
+			if err != nil || (m.remote != remote && m.remotePort() != remote) {
+				continue
+			}
+			local, err := strconv.Atoi(m.local)
+			if err == nil {
+				found = append(found, local)
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return 0, fmt.Errorf("port %s of %s is not forwarded", remote, target)
+	case 1:
+		return found[0], nil
+	}
+	return 0, fmt.Errorf("port %s of %s is ambiguous; specify <type>/<namespace>/<name>", remote, target)
+}
+
+// Requests returns the latest requests forwarded by the targets whose protocol is "http".
+// target is "<name>", "<namespace>/<name>" or "<type>/<namespace>/<name>", or empty for all targets.
+func (r *manifestReconciler) Requests(target string) []RequestLog {
+	r.mu.RLock()
+	ids := make(map[string]bool)
+	for _, forwarder := range r.forwarders {
+		if target == "" || forwarder.target.matches(target) {
+			ids[forwarder.target.id()] = true
+		}
+	}
+	r.mu.RUnlock()
+	return r.requests.list(ids)
+}
+
+// CACertificate returns the PEM of the local CA that issues the certificates of the targets with TLS.
+func (r *manifestReconciler) CACertificate() ([]byte, error) {
+	return r.ca.PEM()
+}
+
+func (r *manifestReconciler) HostEntries() []HostEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.hostEntries()
+}
+
+func (r *manifestReconciler) hostEntries() []HostEntry {
+	hostnames := make(map[string][]string)
+	for _, forwarder := range r.forwarders {
+		if forwarder.loopback == "" {
+			continue
+		}
+		hostnames[forwarder.loopback] = append(hostnames[forwarder.loopback], forwarder.target.serviceHostnames()...)
+	}
+	var entries []HostEntry
+	for ip, names := range hostnames {
+		if len(names) == 0 {
+			continue
+		}
+		sort.Strings(names)
+		entries = append(entries, HostEntry{IP: ip, Hostnames: slices.Compact(names)})
+	}
+	sortHostEntries(entries)
+	return entries
+}
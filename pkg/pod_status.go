@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/kubectl/pkg/util/podutils"
+)
+
+// PodStatus is the status of the pod selected for a target.
+type PodStatus struct {
+	Name  string          `json:"name"`
+	Phase corev1.PodPhase `json:"phase"`
+	Ready bool            `json:"ready"`
+	// Restarts is the sum of the restart counts of the relevant containers.
+	Restarts int32 `json:"restarts"`
+	// Reason is why a relevant container is not running (e.g. "CrashLoopBackOff").
+	Reason string `json:"reason,omitempty"`
+	// LastTermination is the reason and exit code of the last termination of a relevant container (e.g. "OOMKilled (exit 137)").
+	LastTermination string `json:"lastTermination,omitempty"`
+}
+
+// describe summarizes the status, e.g. "Running, CrashLoopBackOff, restarts=5, last terminated: Error (exit 1)".
+func (s *PodStatus) describe() string {
+	parts := []string{string(s.Phase)}
+	if s.Reason != "" {
+		parts = append(parts, s.Reason)
+	}
+	parts = append(parts, fmt.Sprintf("restarts=%d", s.Restarts))
+	if s.LastTermination != "" {
+		parts = append(parts, "last terminated: "+s.LastTermination)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// relevantContainers returns the statuses of container, or of all containers if it is empty.
+func relevantContainers(pod *corev1.Pod, container string) []corev1.ContainerStatus {
+	if container == "" {
+		return pod.Status.ContainerStatuses
+	}
+	for _, s := range pod.Status.ContainerStatuses {
+		if s.Name == container {
+			return []corev1.ContainerStatus{s}
+		}
+	}
+	return nil
+}
+
+// isPodReady reports whether the pod can accept connections to container, or to any container if it is empty.
+func isPodReady(pod *corev1.Pod, container string) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase != corev1.PodRunning {
+		return false
+	}
+	if container == "" {
+		return podutils.IsPodReady(pod)
+	}
+	statuses := relevantContainers(pod, container)
+	return len(statuses) == 1 && statuses[0].Ready
+}
+
+func newPodStatus(pod *corev1.Pod, container string) *PodStatus {
+	status := &PodStatus{
+		Name:  pod.Name,
+		Phase: pod.Status.Phase,
+		Ready: isPodReady(pod, container),
+	}
+	for _, s := range relevantContainers(pod, container) {
+		status.Restarts += s.RestartCount
+		if s.State.Waiting != nil && status.Reason == "" {
+			status.Reason = s.State.Waiting.Reason
+		}
+		if t := s.LastTerminationState.Terminated; t != nil && status.LastTermination == "" {
+			status.LastTermination = fmt.Sprintf("%s (exit %d)", t.Reason, t.ExitCode)
+		}
+	}
+	if pod.DeletionTimestamp != nil {
+		status.Reason = "Terminating"
+	}
+	return status
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package pkg
+
+// portOwner returns the process listening on the TCP port.
+// It is only implemented on Linux.
+func portOwner(port int) string {
+	return ""
+}
@@ -0,0 +1,235 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	portAuto   = "auto"
+	portAll    = "all"
+	unixPrefix = "unix:"
+	udpSuffix  = "/udp"
+	tcpSuffix  = "/tcp"
+)
+
+// portMapping is a parsed entry of Target.Ports.
+type portMapping struct {
+	// local is a port number, or empty if it is allocated automatically.
+	local  string
+	remote string
+	// udp is true if the mapping is suffixed with "/udp".
+	udp bool
+}
+
+func parsePortMapping(port string) (portMapping, error) {
+	m, err := parsePortPair(port)
+	if err != nil {
+		return portMapping{}, err
+	}
+	switch {
+	case strings.HasSuffix(m.remote, udpSuffix):
+		m.remote = strings.TrimSuffix(m.remote, udpSuffix)
+		m.udp = true
+	case strings.HasSuffix(m.remote, tcpSuffix):
+		m.remote = strings.TrimSuffix(m.remote, tcpSuffix)
+	}
+	if m.local == m.remote+udpSuffix || m.local == m.remote+tcpSuffix {
+		m.local = m.remote
+	}
+	if m.remote == "" || (m.udp && m.isUnix()) {
+		return portMapping{}, fmt.Errorf("invalid port: %s", port)
+	}
+	return m, nil
+}
+
+func parsePortPair(port string) (portMapping, error) {
+	if strings.HasPrefix(port, unixPrefix) {
+		// unix:<path>:<remote>
+		i := strings.LastIndex(port, ":")
+		if i <= len(unixPrefix) || i == len(port)-1 {
+			return portMapping{}, fmt.Errorf("invalid port: %s", port)
+		}
+		return portMapping{local: port[:i], remote: port[i+1:]}, nil
+	}
+
+	parts := strings.Split(port, ":")
+	switch len(parts) {
+	case 1:
+		return portMapping{local: parts[0], remote: parts[0]}, nil
+	case 2:
+		local := parts[0]
+		if local == portAuto {
+			local = ""
+		}
+		if parts[1] == "" {
+			return portMapping{}, fmt.Errorf("invalid port: %s", port)
+		}
+		return portMapping{local: local, remote: parts[1]}, nil
+	}
+	return portMapping{}, fmt.Errorf("invalid port: %s", port)
+}
+
+func (m portMapping) isAuto() bool {
+	return m.local == ""
+}
+
+// isUnix reports whether the local side is a unix domain socket.
+func (m portMapping) isUnix() bool {
+	return strings.HasPrefix(m.local, unixPrefix)
+}
+
+func (m portMapping) unixPath() string {
+	return strings.TrimPrefix(m.local, unixPrefix)
+}
+
+// remotePort returns the remote port with the "/udp" suffix for UDP mappings,
+// so that the TCP and UDP ports with the same number can be told apart.
+func (m portMapping) remotePort() string {
+	if m.udp {
+		return m.remote + udpSuffix
+	}
+	return m.remote
+}
+
+func (m portMapping) String() string {
+	if m.local == m.remote {
+		return m.remotePort()
+	}
+	return m.local + ":" + m.remotePort()
+}
+
+// portAllocator assigns free local ports to auto port mappings.
+// The assignments are persisted so that they are stable across reconnects and restarts.
+type portAllocator struct {
+	path string
+
+	mu    sync.Mutex
+	ports map[string]map[string]int
+}
+
+func newPortAllocator(path string) (*portAllocator, error) {
+	a := &portAllocator{
+		path:  path,
+		ports: make(map[string]map[string]int),
+	}
+	if path == "" {
+		return a, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &a.ports); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	return a, nil
+}
+
+// allocate returns the local port assigned to the remote port of the target id.
+func (a *portAllocator) allocate(id string, remote string) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if port, ok := a.ports[id][remote]; ok {
+		return port, nil
+	}
+
+	used := make(map[int]bool)
+	for _, ports := range a.ports {
+		for _, port := range ports {
+			used[port] = true
+		}
+	}
+	var port int
+	for i := 0; i < 10; i++ {
+		p, err := freePort()
+		if err != nil {
+			return 0, err
+		}
+		if !used[p] {
+			port = p
+			break
+		}
+	}
+	if port == 0 {
+		return 0, errors.New("failed to find a free port")
+	}
+
+	if a.ports[id] == nil {
+		a.ports[id] = make(map[string]int)
+	}
+	a.ports[id][remote] = port
+	return port, a.save()
+}
+
+// retain releases the ports of the targets that are not in ids.
+func (a *portAllocator) retain(ids map[string]bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	changed := false
+	for id := range a.ports {
+		if !ids[id] {
+			delete(a.ports, id)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return a.save()
+}
+
+func (a *portAllocator) save() error {
+	if a.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(a.ports, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(a.path, b, 0644)
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// resolvePorts replaces the auto local ports of the mappings with allocated ones.
+func (a *portAllocator) resolvePorts(id string, ports []string) ([]string, error) {
+	resolved := make([]string, 0, len(ports))
+	for _, port := range ports {
+		m, err := parsePortMapping(port)
+		if err != nil {
+			return nil, err
+		}
+		if m.isAuto() {
+			local, err := a.allocate(id, m.remotePort())
+			if err != nil {
+				return nil, err
+			}
+			m.local = strconv.Itoa(local)
+		}
+		resolved = append(resolved, m.String())
+	}
+	return resolved, nil
+}
@@ -0,0 +1,83 @@
+package pkg
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePortMapping(t *testing.T) {
+	tests := []struct {
+		port       string
+		want       portMapping
+		wantString string
+		wantErr    bool
+	}{
+		{port: "8080", want: portMapping{local: "8080", remote: "8080"}, wantString: "8080"},
+		{port: "18080:8080", want: portMapping{local: "18080", remote: "8080"}, wantString: "18080:8080"},
+		{port: "auto:8080", want: portMapping{local: "", remote: "8080"}, wantString: ":8080"},
+		{port: ":8080", want: portMapping{local: "", remote: "8080"}, wantString: ":8080"},
+		{port: "http", want: portMapping{local: "http", remote: "http"}, wantString: "http"},
+		{port: "8080:http", want: portMapping{local: "8080", remote: "http"}, wantString: "8080:http"},
+		{port: "53/udp", want: portMapping{local: "53", remote: "53", udp: true}, wantString: "53/udp"},
+		{port: "5353:53/udp", want: portMapping{local: "5353", remote: "53", udp: true}, wantString: "5353:53/udp"},
+		{port: "auto:53/udp", want: portMapping{local: "", remote: "53", udp: true}, wantString: ":53/udp"},
+		{port: "8080/tcp", want: portMapping{local: "8080", remote: "8080"}, wantString: "8080"},
+		{port: "unix:/tmp/a.sock:8080", want: portMapping{local: "unix:/tmp/a.sock", remote: "8080"}, wantString: "unix:/tmp/a.sock:8080"},
+		{port: "unix:/tmp/a:b.sock:8080", want: portMapping{local: "unix:/tmp/a:b.sock", remote: "8080"}, wantString: "unix:/tmp/a:b.sock:8080"},
+		{port: "", wantErr: true},
+		{port: "8080:", wantErr: true},
+		{port: "1:2:3", wantErr: true},
+		{port: "/udp", wantErr: true},
+		{port: "unix:/tmp/a.sock:53/udp", wantErr: true},
+		{port: "unix:/tmp/a.sock:", wantErr: true},
+		{port: "unix::8080", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.port, func(t *testing.T) {
+			got, err := parsePortMapping(tt.port)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePortMapping() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parsePortMapping() = %+v, want %+v", got, tt.want)
+			}
+			if s := got.String(); s != tt.wantString {
+				t.Errorf("String() = %q, want %q", s, tt.wantString)
+			}
+		})
+	}
+}
+
+func TestPortAllocatorRetain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ports.json")
+	a, err := newPortAllocator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := a.allocate("Service/default/web", "80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.allocate("Service/default/old", "80"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.retain(map[string]bool{"Service/default/web": true}); err != nil {
+		t.Fatalf("retain() error = %v", err)
+	}
+
+	// The released assignments are not loaded again.
+	a, err = newPortAllocator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.ports["Service/default/old"]; ok {
+		t.Errorf("ports of a removed target are kept: %v", a.ports)
+	}
+	if got := a.ports["Service/default/web"]["80"]; got != kept {
+		t.Errorf("port of a retained target = %d, want %d", got, kept)
+	}
+}
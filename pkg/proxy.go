@@ -0,0 +1,519 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/kubectl/pkg/polymorphichelpers"
+	"k8s.io/kubectl/pkg/util"
+	"k8s.io/kubectl/pkg/util/podutils"
+)
+
+const proxyDialTimeout = 10 * time.Second
+
+var errDirectNotAllowed = errors.New("destination is outside of the cluster, which requires proxy.allowDirect")
+
+// defaultPodCIDRs are the private address ranges, one of which the pod network of a cluster usually uses.
+var defaultPodCIDRs = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"}
+
+// proxyServer is a SOCKS5 and HTTP proxy which connects to the pods of the cluster
+// through port-forward streams, so that any Service can be reached without a target.
+// Destinations outside the cluster are connected directly only if ProxyConfig.AllowDirect is set.
+type proxyServer struct {
+	config     ProxyConfig
+	kubeconfig string
+	transport  string
+	api        APIOptions
+	logger     *zap.Logger
+
+	restConfig *rest.Config
+	restClient rest.Interface
+	clientset  *kubernetes.Clientset
+	podCIDRs   []netip.Prefix
+	listener   net.Listener
+	cancel     context.CancelFunc
+
+	mu      sync.Mutex
+	tunnels map[string]*tunnel
+	// dialGroup dials the tunnels to the pods, keyed by "<namespace>/<name>".
+	dialGroup singleflight.Group
+}
+
+func newProxyServer(config ProxyConfig, kubeconfig string, api APIOptions, transport string) *proxyServer {
+	return &proxyServer{
+		config:     config,
+		kubeconfig: kubeconfig,
+		transport:  transport,
+		api:        api,
+		logger:     zap.L().Named("proxy"),
+		tunnels:    make(map[string]*tunnel),
+	}
+}
+
+func (s *proxyServer) start(ctx context.Context) error {
+	cidrs := s.config.PodCIDRs
+	if len(cidrs) == 0 {
+		cidrs = defaultPodCIDRs
+	}
+	s.podCIDRs = nil
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid pod CIDR %q: %w", cidr, err)
+		}
+		s.podCIDRs = append(s.podCIDRs, prefix.Masked())
+	}
+
+	restConfig, restClient, err := newRESTClient(s.kubeconfig, s.api)
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+	s.restConfig = restConfig
+	s.restClient = restClient
+	s.clientset = clientset
+
+	listener, err := net.Listen("tcp", s.config.Listen)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+
+	ctx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, t := range s.tunnels {
+			t.close()
+		}
+		s.tunnels = nil
+	}()
+	go s.serve(ctx)
+
+	s.logger.Info("start proxy server", zap.String("listen", listener.Addr().String()))
+	return nil
+}
+
+func (s *proxyServer) stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+func (s *proxyServer) serve(ctx context.Context) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger.Error("failed to accept", zap.Error(err))
+			}
+			return
+		}
+		go s.handle(ctx, conn)
+	}
+}
+
+// handle serves a SOCKS5 or an HTTP proxy request, which are told apart by the first byte.
+func (s *proxyServer) handle(ctx context.Context, conn net.Conn) {
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	client := &bufferedConn{Conn: conn, r: br}
+	if first[0] == 0x05 {
+		err = s.handleSOCKS(ctx, client, br)
+	} else {
+		err = s.handleHTTP(ctx, client, br)
+	}
+	if err != nil {
+		s.logger.Debug("proxy connection closed", zap.String("client", conn.RemoteAddr().String()), zap.Error(err))
+	}
+}
+
+const (
+	socksVersion            = 0x05
+	socksCmdConnect         = 0x01
+	socksAtypIPv4           = 0x01
+	socksAtypDomain         = 0x03
+	socksAtypIPv6           = 0x04
+	socksSucceeded          = 0x00
+	socksNotAllowed         = 0x02
+	socksHostUnreachable    = 0x04
+	socksCmdNotSupported    = 0x07
+	socksAtypNotSupported   = 0x08
+	socksNoAuthRequired     = 0x00
+	socksNoAcceptableMethod = 0xff
+)
+
+// handleSOCKS serves a SOCKS5 CONNECT request without authentication (RFC 1928).
+func (s *proxyServer) handleSOCKS(ctx context.Context, client net.Conn, r *bufio.Reader) error {
+	defer client.Close()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return err
+	}
+	if !strings.ContainsRune(string(methods), socksNoAuthRequired) {
+		client.Write([]byte{socksVersion, socksNoAcceptableMethod})
+		return errors.New("no acceptable authentication method")
+	}
+	if _, err := client.Write([]byte{socksVersion, socksNoAuthRequired}); err != nil {
+		return err
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return err
+	}
+	var host string
+	switch req[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make([]byte, net.IPv4len)
+		if req[3] == socksAtypIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		l, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		name := make([]byte, l)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return err
+		}
+		host = string(name)
+	default:
+		socksReply(client, socksAtypNotSupported)
+		return fmt.Errorf("unsupported address type: %d", req[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return err
+	}
+	if req[1] != socksCmdConnect {
+		socksReply(client, socksCmdNotSupported)
+		return fmt.Errorf("unsupported command: %d", req[1])
+	}
+
+	remote, err := s.dial(ctx, host, int(binary.BigEndian.Uint16(port)))
+	if errors.Is(err, errDirectNotAllowed) {
+		socksReply(client, socksNotAllowed)
+		return err
+	}
+	if err != nil {
+		socksReply(client, socksHostUnreachable)
+		return err
+	}
+	if err := socksReply(client, socksSucceeded); err != nil {
+		remote.Close()
+		return err
+	}
+	return proxyConn(client, remote)
+}
+
+func socksReply(w io.Writer, status byte) error {
+	// The bound address is not meaningful for the tunneled connections.
+	_, err := w.Write([]byte{socksVersion, status, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// handleHTTP serves a CONNECT request, or a plain HTTP request in absolute form
+// which is sent to the destination with "Connection: close".
+func (s *proxyServer) handleHTTP(ctx context.Context, client net.Conn, r *bufio.Reader) error {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		client.Close()
+		return err
+	}
+
+	addr := req.Host
+	if req.Method != http.MethodConnect {
+		addr = req.URL.Host
+		if req.URL.Scheme != "http" || addr == "" {
+			httpError(client, http.StatusBadRequest, "only CONNECT and http:// requests are supported")
+			return fmt.Errorf("unsupported request: %s %s", req.Method, req.URL)
+		}
+		if req.URL.Port() == "" {
+			addr = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		httpError(client, http.StatusBadRequest, err.Error())
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		httpError(client, http.StatusBadRequest, "invalid port: "+portStr)
+		return err
+	}
+
+	remote, err := s.dial(ctx, host, port)
+	if errors.Is(err, errDirectNotAllowed) {
+		httpError(client, http.StatusForbidden, err.Error())
+		return err
+	}
+	if err != nil {
+		httpError(client, http.StatusBadGateway, err.Error())
+		return err
+	}
+
+	if req.Method == http.MethodConnect {
+		if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+			client.Close()
+			remote.Close()
+			return err
+		}
+		return proxyConn(client, remote)
+	}
+
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	req.Close = true
+	if err := req.Write(remote); err != nil {
+		httpError(client, http.StatusBadGateway, err.Error())
+		remote.Close()
+		return err
+	}
+	return proxyConn(client, remote)
+}
+
+func httpError(conn net.Conn, status int, message string) {
+	defer conn.Close()
+	res := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(message + "\n")),
+		ContentLength: int64(len(message) + 1),
+		Close:         true,
+	}
+	res.Write(conn)
+}
+
+// dial connects to host:port. A host in the cluster is connected through a port-forward stream to its pod.
+func (s *proxyServer) dial(ctx context.Context, host string, port int) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, proxyDialTimeout)
+	defer cancel()
+
+	pod, podPort, err := s.resolve(ctx, host, port)
+	if err != nil {
+		return nil, err
+	}
+	if pod == nil {
+		if !s.config.AllowDirect {
+			return nil, fmt.Errorf("%s: %w", host, errDirectNotAllowed)
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	s.logger.Debug("connecting to pod", zap.String("host", host), zap.String("pod", pod.Namespace+"/"+pod.Name), zap.Int("port", podPort))
+
+	t, err := s.tunnel(pod)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.dial(podPort)
+	if err != nil {
+		// The other streams of the tunnel are kept unless the connection to the pod is lost,
+		// because the port may just be closed.
+		select {
+		case <-t.closeChan():
+			s.dropTunnel(pod, t)
+		default:
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// resolve returns the pod and its port for a destination in the cluster, or a nil pod for other destinations.
+// The host can be "<service>.<namespace>.svc[.cluster.local]", "<hostname>.<service>.<namespace>.svc[.cluster.local]",
+// "<a-b-c-d>.<namespace>.pod[.cluster.local]" or the IP address of a pod.
+func (s *proxyServer) resolve(ctx context.Context, host string, port int) (*corev1.Pod, int, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if !s.isPodIP(ip) {
+			return nil, 0, nil
+		}
+		pod, err := s.podByIP(ctx, "", ip.String())
+		if apierrors.IsForbidden(err) {
+			// Pods cannot be looked up across namespaces, so the address is treated as if it were not a pod.
+			s.logger.Debug("cannot look up pod by IP", zap.String("ip", ip.String()), zap.Error(err))
+			return nil, 0, nil
+		}
+		return pod, port, err
+	}
+
+	name := strings.TrimSuffix(strings.ToLower(host), ".")
+	name = strings.TrimSuffix(name, "."+clusterDomain)
+	parts := strings.Split(name, ".")
+	switch {
+	case len(parts) == 3 && parts[2] == "svc":
+		return s.serviceEndpoint(ctx, parts[1], parts[0], port)
+	case len(parts) == 4 && parts[3] == "svc":
+		pod, err := s.clientset.CoreV1().Pods(parts[2]).Get(ctx, parts[0], metav1.GetOptions{})
+		if err != nil {
+			return nil, 0, err
+		}
+		return pod, port, nil
+	case len(parts) == 3 && parts[2] == "pod":
+		ip := net.ParseIP(strings.ReplaceAll(parts[0], "-", "."))
+		if ip == nil {
+			return nil, 0, fmt.Errorf("invalid pod name: %s", host)
+		}
+		pod, err := s.podByIP(ctx, parts[1], ip.String())
+		if err != nil {
+			return nil, 0, err
+		}
+		if pod == nil {
+			return nil, 0, fmt.Errorf("pod %s is not found", host)
+		}
+		return pod, port, nil
+	}
+	return nil, 0, nil
+}
+
+// isPodIP reports whether ip is in the pod CIDRs.
+func (s *proxyServer) isPodIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range s.podCIDRs {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceEndpoint returns a pod of the Service and its container port for the Service port.
+func (s *proxyServer) serviceEndpoint(ctx context.Context, namespace, name string, port int) (*corev1.Pod, int, error) {
+	svc, err := s.clientset.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(svc.Spec.Selector) == 0 {
+		return nil, 0, fmt.Errorf("service %s/%s has no selector", namespace, name)
+	}
+	selector := labels.SelectorFromSet(svc.Spec.Selector)
+	sortBy := func(pods []*corev1.Pod) sort.Interface { return sort.Reverse(podutils.ActivePods(pods)) }
+	pod, _, err := polymorphichelpers.GetFirstPod(s.clientset.CoreV1(), namespace, selector.String(), 1*time.Second, sortBy)
+	if err != nil {
+		return nil, 0, err
+	}
+	containerPort, err := util.LookupContainerPortNumberByServicePort(*svc, *pod, int32(port))
+	if err != nil {
+		return nil, 0, err
+	}
+	return pod, int(containerPort), nil
+}
+
+// podByIP returns the running pod with the IP address, or nil if there is none.
+func (s *proxyServer) podByIP(ctx context.Context, namespace, ip string) (*corev1.Pod, error) {
+	pods, err := s.clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: "status.podIP=" + ip + ",status.phase=Running",
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		// Pods on the host network share the IP of the node.
+		if !pods.Items[i].Spec.HostNetwork {
+			return &pods.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// tunnel returns the connection to the pod, which is shared by the proxied connections.
+// It is dialed without holding the lock, so that a slow pod does not block the connections to the others,
+// and only once for the concurrent connections to the same pod.
+func (s *proxyServer) tunnel(pod *corev1.Pod) (*tunnel, error) {
+	key := pod.Namespace + "/" + pod.Name
+	s.mu.Lock()
+	t, ok := s.tunnels[key]
+	s.mu.Unlock()
+	if ok {
+		return t, nil
+	}
+
+	v, err, _ := s.dialGroup.Do(key, func() (interface{}, error) {
+		s.mu.Lock()
+		t, ok := s.tunnels[key]
+		s.mu.Unlock()
+		if ok {
+			return t, nil
+		}
+
+		dialer, err := newPodDialer(s.restConfig, s.restClient, pod, s.transport, s.api.netDialer())
+		if err != nil {
+			return nil, err
+		}
+		t, err = dialTunnel(dialer, pod.Name)
+		if err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.tunnels == nil {
+			// The proxy has been stopped while dialing.
+			t.close()
+			return nil, errors.New("proxy server is stopped")
+		}
+		s.tunnels[key] = t
+		go func() {
+			<-t.closeChan()
+			s.dropTunnel(pod, t)
+		}()
+		return t, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*tunnel), nil
+}
+
+func (s *proxyServer) dropTunnel(pod *corev1.Pod, t *tunnel) {
+	key := pod.Namespace + "/" + pod.Name
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tunnels[key] == t {
+		delete(s.tunnels, key)
+		t.close()
+	}
+}
@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// accessCheck is a permission required by a target.
+type accessCheck struct {
+	verb        string
+	group       string
+	resource    string
+	subresource string
+	name        string
+}
+
+func (c accessCheck) String() string {
+	resource := c.resource
+	if c.group != "" {
+		resource += "." + c.group
+	}
+	if c.subresource != "" {
+		resource += "/" + c.subresource
+	}
+	return c.verb + " " + resource
+}
+
+// accessChecks returns the permissions required to forward the target.
+func (t Target) accessChecks() []accessCheck {
+	var checks []accessCheck
+	switch t.ObjectType {
+	case "Deployment":
+		checks = append(checks, accessCheck{verb: "get", group: "apps", resource: "deployments", name: t.Name})
+	case "StatefulSet":
+		checks = append(checks, accessCheck{verb: "get", group: "apps", resource: "statefulsets", name: t.Name})
+	case "Service":
+		checks = append(checks, accessCheck{verb: "get", resource: "services", name: t.Name})
+	case "Reverse":
+		checks = append(checks,
+			accessCheck{verb: "get", resource: "services", name: t.Name},
+			accessCheck{verb: "create", resource: "services"},
+			accessCheck{verb: "update", resource: "services", name: t.Name},
+		)
+	}
+	if t.ObjectType != "Remote" && t.ObjectType != "Reverse" {
+		checks = append(checks, accessCheck{verb: "list", resource: "pods"})
+	}
+	if t.needsRelay() {
+		checks = append(checks,
+			accessCheck{verb: "get", resource: "pods"},
+			accessCheck{verb: "create", resource: "pods"},
+			accessCheck{verb: "delete", resource: "pods"},
+		)
+	}
+	checks = append(checks, accessCheck{verb: "create", resource: "pods", subresource: "portforward"})
+	return checks
+}
+
+// needsRelay reports whether the target runs a relay pod.
+func (t Target) needsRelay() bool {
+	if t.ObjectType == "Remote" || t.ObjectType == "Reverse" {
+		return true
+	}
+	for _, port := range t.Ports {
+		if strings.HasSuffix(port, udpSuffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAccess asks the API server whether the permissions required by the target are granted,
+// so that a missing one is reported precisely instead of as an opaque error on every retry.
+// The check is skipped if the API server cannot answer it, and is not repeated once it has passed.
+func (f *Forwarder) checkAccess(ctx context.Context, clientset *kubernetes.Clientset) error {
+	if f.accessChecked {
+		return nil
+	}
+	var missing []string
+	for _, c := range f.target.accessChecks() {
+		review, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace:   f.target.Namespace,
+					Verb:        c.verb,
+					Group:       c.group,
+					Resource:    c.resource,
+					Subresource: c.subresource,
+					Name:        c.name,
+				},
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			f.logger.Debug("skip access check", zap.String("check", c.String()), zap.Error(err))
+			return nil
+		}
+		if !review.Status.Allowed {
+			missing = append(missing, c.String())
+		}
+	}
+	if len(missing) > 0 {
+		err := fmt.Errorf("forbidden: missing %s in namespace %s", strings.Join(missing, ", "), f.target.Namespace)
+		return &stateError{state: StateForbidden, err: err}
+	}
+	f.accessChecked = true
+	return nil
+}
@@ -0,0 +1,320 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The relay runs in a helper pod and connects the streams port-forwarded to it to other endpoints.
+// A client starts a stream with a request line "<network> <address>\n" and the relay answers
+// "ok\n" or "error <message>\n". Then, a "tcp" stream carries the raw bytes of the connection,
+// and a "udp" stream carries datagrams, each prefixed with its length as a 2-byte big endian integer.
+//
+// For reverse tunnels, a "listen <address>" stream makes the relay listen on the address,
+// and receives a line "conn <id>\n" for each accepted connection. The client claims the connection
+// by starting another stream with "accept <id>", which then carries the raw bytes of it.
+//
+// The relay listens on the loopback address of the pod, which is reachable through port-forward
+// but not from the other pods, because it connects to anywhere it is asked to.
+const (
+	relayPort          = 9000
+	relayAddress       = "127.0.0.1:9000"
+	relayDialTimeout   = 10 * time.Second
+	relayAcceptTimeout = 10 * time.Second
+	maxDatagramSize    = 65535
+	maxRelayLineSize   = 1024
+)
+
+type relayServer struct {
+	mu      sync.Mutex
+	pending map[string]net.Conn
+}
+
+// RunRelay serves the relay protocol on addr until ctx is canceled.
+func RunRelay(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	zap.L().Info("relay started", zap.String("address", addr))
+
+	r := &relayServer{pending: make(map[string]net.Conn)}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go r.handle(conn)
+	}
+}
+
+// ProbeRelay checks that the relay is accepting connections on addr.
+func ProbeRelay(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (r *relayServer) handle(conn net.Conn) {
+	logger := zap.L()
+	br := bufio.NewReaderSize(conn, maxRelayLineSize)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		// The readiness probe connects and closes without a request.
+		if !errors.Is(err, io.EOF) || line != "" {
+			logger.Error("failed to read request", zap.Error(err))
+		}
+		conn.Close()
+		return
+	}
+	network, addr, _ := strings.Cut(strings.TrimSpace(line), " ")
+	logger = logger.With(zap.String("network", network), zap.String("address", addr))
+
+	local := &bufferedConn{Conn: conn, r: br}
+	var remote net.Conn
+	switch network {
+	case "listen":
+		r.listen(local, addr, logger)
+		return
+	case "accept":
+		remote, err = r.accept(addr)
+	case "tcp":
+		remote, err = net.DialTimeout("tcp", addr, relayDialTimeout)
+	case "udp":
+		remote, err = net.Dial("udp", addr)
+	default:
+		err = fmt.Errorf("unsupported network: %q", network)
+	}
+	if err != nil {
+		logger.Error("failed to connect", zap.Error(err))
+		fmt.Fprintf(conn, "error %s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+		conn.Close()
+		return
+	}
+	if _, err := io.WriteString(conn, "ok\n"); err != nil {
+		conn.Close()
+		remote.Close()
+		return
+	}
+	logger.Debug("connected")
+
+	switch network {
+	case "udp":
+		err = relayDatagrams(local, remote)
+	case "accept":
+		// The server of an accepted connection is on the client side of the stream.
+		err = proxyConn(remote, local)
+	default:
+		err = proxyConn(local, remote)
+	}
+	logger.Debug("disconnected", zap.Error(err))
+}
+
+// listen accepts connections on addr until the control stream is closed,
+// and announces each of them on the control stream to be claimed by accept.
+func (r *relayServer) listen(control net.Conn, addr string, logger *zap.Logger) {
+	defer control.Close()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Error("failed to listen", zap.Error(err))
+		fmt.Fprintf(control, "error %s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+		return
+	}
+	defer l.Close()
+	if _, err := io.WriteString(control, "ok\n"); err != nil {
+		return
+	}
+	logger.Info("listening")
+
+	go func() {
+		// Nothing is sent by the client, so this returns when the client goes away.
+		io.Copy(io.Discard, control)
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			logger.Info("stopped listening", zap.Error(err))
+			return
+		}
+		id, err := newConnectionID()
+		if err != nil {
+			logger.Error("failed to generate connection id", zap.Error(err))
+			conn.Close()
+			continue
+		}
+		r.mu.Lock()
+		r.pending[id] = conn
+		r.mu.Unlock()
+
+		time.AfterFunc(relayAcceptTimeout, func() {
+			if c := r.take(id); c != nil {
+				logger.Warn("connection was not accepted by the client", zap.String("remote", c.RemoteAddr().String()))
+				c.Close()
+			}
+		})
+		if _, err := fmt.Fprintf(control, "conn %s\n", id); err != nil {
+			return
+		}
+	}
+}
+
+// newConnectionID returns a random id of an accepted connection, which cannot be guessed to claim it.
+func newConnectionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// accept returns the pending connection announced with id.
+func (r *relayServer) accept(id string) (net.Conn, error) {
+	conn := r.take(id)
+	if conn == nil {
+		return nil, fmt.Errorf("connection %q is not pending", id)
+	}
+	return conn, nil
+}
+
+func (r *relayServer) take(id string) net.Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conn := r.pending[id]
+	delete(r.pending, id)
+	return conn
+}
+
+// relayDatagrams sends the datagrams framed on stream to the connected UDP socket and vice versa.
+func relayDatagrams(stream net.Conn, udp net.Conn) error {
+	defer stream.Close()
+	defer udp.Close()
+
+	go func() {
+		for {
+			b, err := readDatagram(stream)
+			if err != nil {
+				udp.Close()
+				return
+			}
+			udp.Write(b)
+		}
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := udp.Read(buf)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			// Nobody is listening on the destination for now.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := writeDatagram(stream, buf[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+// dialRelay opens a stream to the relay through the tunnel and asks it to connect to addr.
+func dialRelay(t *tunnel, network, addr string) (net.Conn, error) {
+	conn, err := requestRelay(t, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("relay failed to connect to %s: %w", addr, err)
+	}
+	return conn, nil
+}
+
+// requestRelay opens a stream to the relay through the tunnel and sends the request line.
+func requestRelay(t *tunnel, request, arg string) (net.Conn, error) {
+	conn, err := t.dial(relayPort)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(conn, "%s %s\n", request, arg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The reply is read byte by byte, so that nothing that follows it is consumed.
+	var reply []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to read reply from relay: %w", err)
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if len(reply) >= maxRelayLineSize {
+			conn.Close()
+			return nil, errors.New("too long reply from relay")
+		}
+		reply = append(reply, b[0])
+	}
+	if s := string(reply); s != "ok" {
+		conn.Close()
+		return nil, errors.New(strings.TrimPrefix(s, "error "))
+	}
+	return conn, nil
+}
+
+func writeDatagram(w io.Writer, b []byte) error {
+	// The length and the payload are written at once, so that a frame is never split by another writer.
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readDatagram(r io.Reader) ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(header[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// bufferedConn is a connection whose beginning has been read into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
@@ -0,0 +1,212 @@
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/kubectl/pkg/util/podutils"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	defaultRelayImage = "ghcr.io/zoetrope/kube-porter"
+	relayBinary       = "/usr/local/bin/kube-porter"
+	relayPodTimeout   = 2 * time.Minute
+	relayLabelKey     = "app.kubernetes.io/managed-by"
+	relayLabelValue   = "kube-porter"
+	relayNameKey      = "kube-porter.zoetrope.github.io/relay"
+	relayTargetKey    = "kube-porter.zoetrope.github.io/target"
+	relayHostKey      = "kube-porter.zoetrope.github.io/host"
+)
+
+func (c *RelayConfig) image() string {
+	if c != nil && c.Image != "" {
+		return c.Image
+	}
+	if Version == "unset" {
+		return defaultRelayImage + ":latest"
+	}
+	return defaultRelayImage + ":" + Version
+}
+
+// relayPodName returns the name of the relay pod of the target.
+// It is unique to the local host, so that users sharing the cluster do not share relays.
+func relayPodName(target Target) string {
+	hostname, _ := os.Hostname()
+	sum := sha256.Sum256([]byte(hostname + "/" + target.id()))
+	return "kube-porter-relay-" + hex.EncodeToString(sum[:])[:10]
+}
+
+func newRelayPod(target Target, namespace, name string) *corev1.Pod {
+	hostname, _ := os.Hostname()
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				relayLabelKey: relayLabelValue,
+				relayNameKey:  name,
+			},
+			Annotations: map[string]string{
+				relayTargetKey: target.id(),
+				relayHostKey:   hostname,
+			},
+		},
+		Spec: corev1.PodSpec{
+			AutomountServiceAccountToken:  ptr.To(false),
+			TerminationGracePeriodSeconds: ptr.To[int64](1),
+			SecurityContext: &corev1.PodSecurityContext{
+				RunAsNonRoot: ptr.To(true),
+				RunAsUser:    ptr.To[int64](65532),
+				SeccompProfile: &corev1.SeccompProfile{
+					Type: corev1.SeccompProfileTypeRuntimeDefault,
+				},
+			},
+			Containers: []corev1.Container{
+				{
+					Name:  "relay",
+					Image: target.Relay.image(),
+					Args:  []string{"relay", "--listen", relayAddress},
+					// The kubelet cannot reach the loopback address of the pod, so the relay probes itself.
+					ReadinessProbe: &corev1.Probe{
+						ProbeHandler: corev1.ProbeHandler{
+							Exec: &corev1.ExecAction{
+								Command: []string{relayBinary, "relay", "--probe", "--listen", relayAddress},
+							},
+						},
+						PeriodSeconds: 2,
+					},
+					SecurityContext: &corev1.SecurityContext{
+						AllowPrivilegeEscalation: ptr.To(false),
+						ReadOnlyRootFilesystem:   ptr.To(true),
+						Capabilities: &corev1.Capabilities{
+							Drop: []corev1.Capability{"ALL"},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// ensureRelayPod creates the relay pod of the target in namespace unless it exists, and waits for it to be ready.
+func (f *Forwarder) ensureRelayPod(ctx context.Context, clientset *kubernetes.Clientset, namespace string) (*corev1.Pod, error) {
+	pods := clientset.CoreV1().Pods(namespace)
+	name := relayPodName(f.target)
+	f.relayPod = &metav1.ObjectMeta{Namespace: namespace, Name: name}
+
+	pod, err := pods.Get(ctx, name, metav1.GetOptions{})
+	if err == nil && pod.DeletionTimestamp != nil {
+		// The relay pod of a forwarder that has just been replaced can still be terminating.
+		err = wait.PollUntilContextTimeout(ctx, time.Second, relayPodTimeout, true, func(ctx context.Context) (bool, error) {
+			_, err := pods.Get(ctx, name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				return true, nil
+			}
+			return false, err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("relay pod %s/%s is being deleted: %w", namespace, name, err)
+		}
+		err = apierrors.NewNotFound(corev1.Resource("pods"), name)
+	}
+	if apierrors.IsNotFound(err) {
+		f.logger.Info("creating relay pod", zap.String("pod", namespace+"/"+name))
+		pod, err = pods.Create(ctx, newRelayPod(f.target, namespace, name), metav1.CreateOptions{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create relay pod: %w", err)
+	}
+
+	var reason error
+	err = wait.PollUntilContextTimeout(ctx, time.Second, relayPodTimeout, true, func(ctx context.Context) (bool, error) {
+		pod, err = pods.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if pod.DeletionTimestamp != nil {
+			return false, fmt.Errorf("relay pod %s/%s is being deleted", namespace, name)
+		}
+		if pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded {
+			return false, fmt.Errorf("relay pod %s/%s has terminated", namespace, name)
+		}
+		for _, cs := range pod.Status.ContainerStatuses {
+			if cs.State.Waiting != nil && cs.State.Waiting.Message != "" {
+				reason = fmt.Errorf("%s: %s", cs.State.Waiting.Reason, cs.State.Waiting.Message)
+			}
+		}
+		return podutils.IsPodReady(pod), nil
+	})
+	if err != nil {
+		// A pod that does not come up is recreated on the next attempt, in case the image has been fixed.
+		f.deleteRelayPod()
+		if reason != nil && errors.Is(err, context.DeadlineExceeded) {
+			return nil, fmt.Errorf("relay pod %s/%s is not ready: %w", namespace, name, reason)
+		}
+		return nil, fmt.Errorf("relay pod %s/%s is not ready: %w", namespace, name, err)
+	}
+	return pod, nil
+}
+
+// deleteRelayPod deletes the relay pod created by ensureRelayPod, if any.
+func (f *Forwarder) deleteRelayPod() {
+	if f.relayPod == nil {
+		return
+	}
+	clientset, err := kubernetes.NewForConfig(f.config)
+	if err != nil {
+		f.logger.Error("failed to delete relay pod", zap.Error(err))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = clientset.CoreV1().Pods(f.relayPod.Namespace).Delete(ctx, f.relayPod.Name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		f.logger.Error("failed to delete relay pod", zap.String("pod", f.relayPod.Namespace+"/"+f.relayPod.Name), zap.Error(err))
+		return
+	}
+	f.logger.Info("deleted relay pod", zap.String("pod", f.relayPod.Namespace+"/"+f.relayPod.Name))
+	f.relayPod = nil
+}
+
+// deleteStaleRelayPods deletes the relay pods in namespace created on this host.
+func deleteStaleRelayPods(ctx context.Context, config *rest.Config, namespace string) error {
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	hostname, _ := os.Hostname()
+	pods := clientset.CoreV1().Pods(namespace)
+	podList, err := pods.List(ctx, metav1.ListOptions{
+		LabelSelector: relayLabelKey + "=" + relayLabelValue + "," + relayNameKey,
+	})
+	if err != nil {
+		return err
+	}
+	for _, pod := range podList.Items {
+		if pod.Annotations[relayHostKey] != hostname {
+			continue
+		}
+		err := pods.Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		zap.L().Info("deleted stale relay pod", zap.String("pod", namespace+"/"+pod.Name))
+	}
+	return nil
+}
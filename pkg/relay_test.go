@@ -0,0 +1,197 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{name: "empty", payload: []byte{}},
+		{name: "short", payload: []byte("hello")},
+		{name: "max", payload: bytes.Repeat([]byte{0xff}, maxDatagramSize)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeDatagram(&buf, tt.payload); err != nil {
+				t.Fatalf("writeDatagram() error = %v", err)
+			}
+			if buf.Len() != 2+len(tt.payload) {
+				t.Fatalf("frame length = %d, want %d", buf.Len(), 2+len(tt.payload))
+			}
+			got, err := readDatagram(&buf)
+			if err != nil {
+				t.Fatalf("readDatagram() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.payload) {
+				t.Errorf("readDatagram() = %d bytes, want %d", len(got), len(tt.payload))
+			}
+		})
+	}
+}
+
+func TestReadDatagramTruncated(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  error
+	}{
+		{name: "no header", frame: nil, want: io.EOF},
+		{name: "short header", frame: []byte{0}, want: io.ErrUnexpectedEOF},
+		{name: "short payload", frame: []byte{0, 3, 'a'}, want: io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readDatagram(bytes.NewReader(tt.frame)); err != tt.want {
+				t.Errorf("readDatagram() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// startEchoServer listens on a loopback port and echoes the connections.
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// sendRelayRequest serves a connection with the relay and sends the request line on it.
+func sendRelayRequest(t *testing.T, r *relayServer, line string) (net.Conn, *bufio.Reader, string) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go r.handle(server)
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(client, line+"\n"); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	br := bufio.NewReader(client)
+	reply, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	return client, br, strings.TrimSuffix(reply, "\n")
+}
+
+func TestRelayRequest(t *testing.T) {
+	echo := startEchoServer(t)
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	tests := []struct {
+		name      string
+		line      string
+		wantReply string
+	}{
+		{name: "tcp", line: "tcp " + echo, wantReply: "ok"},
+		{name: "refused", line: "tcp " + closedAddr, wantReply: "error "},
+		{name: "unsupported network", line: "sctp " + echo, wantReply: `error unsupported network: "sctp"`},
+		{name: "unknown connection", line: "accept 0123", wantReply: `error connection "0123" is not pending`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &relayServer{pending: make(map[string]net.Conn)}
+			conn, br, reply := sendRelayRequest(t, r, tt.line)
+			if !strings.HasPrefix(reply, tt.wantReply) {
+				t.Fatalf("reply = %q, want prefix %q", reply, tt.wantReply)
+			}
+			if reply != "ok" {
+				return
+			}
+			if _, err := io.WriteString(conn, "ping"); err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(br, b); err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != "ping" {
+				t.Errorf("echo = %q, want %q", b, "ping")
+			}
+		})
+	}
+}
+
+func TestRelayListenAccept(t *testing.T) {
+	// The relay does not report the address it listens on, so a free port is picked beforehand.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	r := &relayServer{pending: make(map[string]net.Conn)}
+	_, control, reply := sendRelayRequest(t, r, "listen "+addr)
+	if reply != "ok" {
+		t.Fatalf("listen reply = %q, want %q", reply, "ok")
+	}
+
+	peer, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	line, err := control.ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read announcement: %v", err)
+	}
+	id, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), "conn ")
+	if !ok || len(id) != 32 {
+		t.Fatalf("announcement = %q, want conn with a 128-bit hex id", line)
+	}
+
+	conn, br, reply := sendRelayRequest(t, r, "accept "+id)
+	if reply != "ok" {
+		t.Fatalf("accept reply = %q, want %q", reply, "ok")
+	}
+	if _, err := io.WriteString(peer, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(br, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ping" {
+		t.Errorf("accepted = %q, want %q", b, "ping")
+	}
+	conn.Close()
+
+	// A connection is claimed only once.
+	_, _, reply = sendRelayRequest(t, r, "accept "+id)
+	if !strings.HasPrefix(reply, "error ") {
+		t.Errorf("second accept reply = %q, want an error", reply)
+	}
+}
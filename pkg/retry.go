@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	defaultRetryInitial    = 1 * time.Second
+	defaultRetryMax        = 30 * time.Second
+	defaultRetryMultiplier = 2.0
+)
+
+// merge returns a policy that takes each unset field of override from p.
+func (p *RetryPolicy) merge(override *RetryPolicy) *RetryPolicy {
+	if p == nil {
+		return override
+	}
+	if override == nil {
+		merged := *p
+		return &merged
+	}
+	merged := *override
+	if merged.Initial.Duration == 0 {
+		merged.Initial = p.Initial
+	}
+	if merged.Max.Duration == 0 {
+		merged.Max = p.Max
+	}
+	if merged.Multiplier == 0 {
+		merged.Multiplier = p.Multiplier
+	}
+	if merged.Jitter == 0 {
+		merged.Jitter = p.Jitter
+	}
+	if merged.MaxFailures == 0 {
+		merged.MaxFailures = p.MaxFailures
+	}
+	return &merged
+}
+
+// backoff computes the delays between reconnection attempts.
+type backoff struct {
+	initial     time.Duration
+	max         time.Duration
+	multiplier  float64
+	jitter      float64
+	maxFailures int
+
+	current  time.Duration
+	failures int
+}
+
+func newBackoff(p *RetryPolicy) *backoff {
+	b := &backoff{
+		initial:    defaultRetryInitial,
+		max:        defaultRetryMax,
+		multiplier: defaultRetryMultiplier,
+	}
+	if p != nil {
+		if p.Initial.Duration > 0 {
+			b.initial = p.Initial.Duration
+		}
+		if p.Max.Duration > 0 {
+			b.max = p.Max.Duration
+		}
+		if p.Multiplier >= 1 {
+			b.multiplier = p.Multiplier
+		}
+		if p.Jitter > 0 {
+			b.jitter = min(p.Jitter, 1)
+		}
+		b.maxFailures = p.MaxFailures
+	}
+	if b.max < b.initial {
+		b.max = b.initial
+	}
+	b.current = b.initial
+	return b
+}
+
+// success resets the backoff and returns the delay before the next attempt.
+func (b *backoff) success() time.Duration {
+	b.failures = 0
+	b.current = b.initial
+	return b.withJitter(b.current)
+}
+
+// failure returns the delay before the next attempt,
+// or false if the maximum number of consecutive failures has been reached.
+func (b *backoff) failure() (time.Duration, bool) {
+	b.failures++
+	if b.maxFailures > 0 && b.failures >= b.maxFailures {
+		return 0, false
+	}
+	d := b.current
+	b.current = min(time.Duration(float64(b.current)*b.multiplier), b.max)
+	return b.withJitter(d), true
+}
+
+func (b *backoff) withJitter(d time.Duration) time.Duration {
+	if b.jitter == 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + b.jitter*(2*rand.Float64()-1)))
+}
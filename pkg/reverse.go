@@ -0,0 +1,207 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+// reverseBasePort is the first port the relay listens on for a reverse target.
+// The Service maps its ports to them, so that the relay does not need to bind privileged ports.
+const reverseBasePort = 10000
+
+// reverse exposes the local ports of a reverse target as a Service in the cluster,
+// which is backed by the relay pod that tunnels the connections back through the port-forward.
+func (f *Forwarder) reverse(ctx context.Context) error {
+	ports, err := f.reversePorts()
+	if err != nil {
+		return err
+	}
+
+	clientset, err := kubernetes.NewForConfig(f.config)
+	if err != nil {
+		return err
+	}
+	if err := f.checkAccess(ctx, clientset); err != nil {
+		return err
+	}
+	pod, err := f.ensureRelayPod(ctx, clientset, f.target.Namespace)
+	if err != nil {
+		return err
+	}
+	if err := f.ensureReverseService(ctx, clientset, pod, ports); err != nil {
+		return err
+	}
+
+	fwCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	t, err := f.openTunnel(fwCtx, cancel, pod)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+
+	for i, m := range ports {
+		control, err := requestRelay(t, "listen", fmt.Sprintf(":%d", reverseBasePort+i))
+		if err != nil {
+			return fmt.Errorf("relay failed to listen for port %s: %w", m.remote, err)
+		}
+		defer control.Close()
+		go func() {
+			cancel(f.acceptReverse(t, control, m))
+		}()
+	}
+
+	f.setState(StateForwarding, "")
+	f.logger.Info("start reverse forwarding", zap.String("service", f.target.Namespace+"/"+f.target.Name))
+	<-fwCtx.Done()
+	if cause := context.Cause(fwCtx); cause != nil && !errors.Is(cause, context.Canceled) {
+		return cause
+	}
+	if ctx.Err() != nil {
+		f.logger.Info("stop forwarding")
+		return nil
+	}
+	f.logger.Info("lost connection")
+	return nil
+}
+
+// reversePorts returns the port mappings of the reverse target, whose local sides are the ports to connect to.
+func (f *Forwarder) reversePorts() ([]portMapping, error) {
+	if f.target.Ports.isAll() {
+		return nil, errors.New("ports must be specified for a reverse target")
+	}
+	var ports []portMapping
+	for _, port := range f.target.Ports {
+		m, err := parsePortMapping(port)
+		if err != nil {
+			return nil, err
+		}
+		if m.isAuto() || m.udp {
+			return nil, fmt.Errorf("invalid port for a reverse target: %s", port)
+		}
+		if _, err := strconv.Atoi(m.remote); err != nil {
+			return nil, fmt.Errorf("invalid port for a reverse target: %s", port)
+		}
+		ports = append(ports, m)
+	}
+	f.mu.Lock()
+	f.resolvedPorts = f.target.Ports
+	f.mu.Unlock()
+	return ports, nil
+}
+
+// acceptReverse claims the connections announced on the control stream and connects them to the local port.
+// It returns when the relay stops listening.
+func (f *Forwarder) acceptReverse(t *tunnel, control net.Conn, m portMapping) error {
+	network, addr := "tcp", net.JoinHostPort(dialHost(f.addresses()[0]), m.local)
+	if m.isUnix() {
+		network, addr = "unix", m.unixPath()
+	}
+	f.logger.Info("forwarding to local", zap.String("port", m.remote), zap.String("address", addr))
+
+	r := bufio.NewReader(control)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("relay stopped listening for port %s: %w", m.remote, err)
+		}
+		id, ok := strings.CutPrefix(strings.TrimSpace(line), "conn ")
+		if !ok {
+			continue
+		}
+		go func() {
+			remote, err := requestRelay(t, "accept", id)
+			if err != nil {
+				f.logger.Error("failed to accept connection", zap.String("port", m.remote), zap.Error(err))
+				return
+			}
+			local, err := net.Dial(network, addr)
+			if err != nil {
+				f.logger.Error("failed to connect to local", zap.String("address", addr), zap.Error(err))
+				remote.Close()
+				return
+			}
+			// The local port is the server, so the connection is closed when it is done.
+			if err := proxyConn(remote, local); err != nil {
+				f.logger.Debug("connection closed", zap.String("address", addr), zap.Error(err))
+			}
+		}()
+	}
+}
+
+// ensureReverseService creates or updates the Service of the reverse target to route to the relay pod.
+// The Service is owned by the pod, so that it is garbage-collected together with it.
+func (f *Forwarder) ensureReverseService(ctx context.Context, clientset *kubernetes.Clientset, pod *corev1.Pod, ports []portMapping) error {
+	hostname, _ := os.Hostname()
+	services := clientset.CoreV1().Services(f.target.Namespace)
+
+	var servicePorts []corev1.ServicePort
+	for i, m := range ports {
+		port, _ := strconv.Atoi(m.remote)
+		servicePorts = append(servicePorts, corev1.ServicePort{
+			Name:       "port-" + m.remote,
+			Protocol:   corev1.ProtocolTCP,
+			Port:       int32(port),
+			TargetPort: intstr.FromInt32(int32(reverseBasePort + i)),
+		})
+	}
+	ownerReferences := []metav1.OwnerReference{
+		{APIVersion: "v1", Kind: "Pod", Name: pod.Name, UID: pod.UID},
+	}
+	selector := map[string]string{relayNameKey: pod.Name}
+
+	svc, err := services.Get(ctx, f.target.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		f.logger.Info("creating service", zap.String("service", f.target.Namespace+"/"+f.target.Name))
+		_, err = services.Create(ctx, &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      f.target.Name,
+				Namespace: f.target.Namespace,
+				Labels: map[string]string{
+					relayLabelKey: relayLabelValue,
+				},
+				Annotations: map[string]string{
+					relayTargetKey: f.target.id(),
+					relayHostKey:   hostname,
+				},
+				OwnerReferences: ownerReferences,
+			},
+			Spec: corev1.ServiceSpec{
+				Selector: selector,
+				Ports:    servicePorts,
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to create service: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if svc.Labels[relayLabelKey] != relayLabelValue || svc.Annotations[relayHostKey] != hostname {
+		return fmt.Errorf("service %s/%s already exists and is not managed by kube-porter on this host", svc.Namespace, svc.Name)
+	}
+	svc.OwnerReferences = ownerReferences
+	svc.Spec.Selector = selector
+	svc.Spec.Ports = servicePorts
+	if _, err := services.Update(ctx, svc, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update service: %w", err)
+	}
+	return nil
+}
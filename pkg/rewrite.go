@@ -0,0 +1,83 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+func (r *HTTPRewrite) validate() error {
+	for _, h := range r.Headers {
+		if h.Name == "" {
+			return errors.New("header name must be specified")
+		}
+		n := 0
+		for _, s := range []string{h.Value, h.File, h.Env} {
+			if s != "" {
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("exactly one of value, file and env must be specified for header %s", h.Name)
+		}
+	}
+	for _, prefix := range []string{r.StripPrefix, r.AddPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("path prefix must start with /: %s", prefix)
+		}
+	}
+	return nil
+}
+
+// headers returns the headers to be set on a request.
+func (r *HTTPRewrite) headers() (http.Header, error) {
+	header := make(http.Header, len(r.Headers))
+	for _, h := range r.Headers {
+		value := h.Value
+		switch {
+		case h.File != "":
+			b, err := os.ReadFile(h.File)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read header %s: %w", h.Name, err)
+			}
+			value = strings.TrimSpace(string(b))
+		case h.Env != "":
+			v, ok := os.LookupEnv(h.Env)
+			if !ok {
+				return nil, fmt.Errorf("environment variable %s for header %s is not set", h.Env, h.Name)
+			}
+			value = v
+		}
+		header.Set(h.Name, value)
+	}
+	return header, nil
+}
+
+// rewritePath strips and adds the path prefixes of u.
+func (r *HTTPRewrite) rewritePath(u *url.URL) {
+	if r.StripPrefix == "" && r.AddPrefix == "" {
+		return
+	}
+	rewrite := func(path string) string {
+		if r.StripPrefix != "" {
+			prefix := strings.TrimSuffix(r.StripPrefix, "/")
+			if path == prefix || strings.HasPrefix(path, prefix+"/") {
+				path = strings.TrimPrefix(path, prefix)
+			}
+		}
+		if r.AddPrefix != "" {
+			path = strings.TrimSuffix(r.AddPrefix, "/") + "/" + strings.TrimPrefix(path, "/")
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		return path
+	}
+	u.Path = rewrite(u.Path)
+	if u.RawPath != "" {
+		u.RawPath = rewrite(u.RawPath)
+	}
+}
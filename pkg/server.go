@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -26,13 +27,28 @@ type Server struct {
 	reconciler *manifestReconciler
 }
 
-func NewServer(socketAddr string, kubeconfig string, manifest string, logFilePath string) *Server {
-	reconciler := newManifestReconciler(kubeconfig, manifest)
+type ServerOptions struct {
+	SocketAddr  string
+	Kubeconfig  string
+	Manifest    string
+	LogFilePath string
+	// StateDir is the directory where kube-porter persists its state, such as allocated ports.
+	StateDir string
+	// AllowNonLoopback permits targets to listen on addresses reachable from other hosts.
+	AllowNonLoopback bool
+	// HostsFile is the hosts file that "kube-porter hosts apply" keeps in sync.
+	HostsFile string
+	// API tunes the connections to the API server.
+	API APIOptions
+}
+
+func NewServer(opts ServerOptions) *Server {
+	reconciler := newManifestReconciler(opts)
 	return &Server{
-		socketAddr:  socketAddr,
-		kubeconfig:  kubeconfig,
-		manifest:    manifest,
-		logFilePath: logFilePath,
+		socketAddr:  opts.SocketAddr,
+		kubeconfig:  opts.Kubeconfig,
+		manifest:    opts.Manifest,
+		logFilePath: opts.LogFilePath,
 		logger:      zap.L().Named("server"),
 		reconciler:  reconciler,
 	}
@@ -56,6 +72,10 @@ func (s Server) Run() error {
 	mux.HandleFunc("/ready", ready)
 	mux.HandleFunc("/status", s.getForwarderList)
 	mux.HandleFunc("/logfile", s.getLogFilePath)
+	mux.HandleFunc("/hosts", s.handleHosts)
+	mux.HandleFunc("/port", s.getPort)
+	mux.HandleFunc("/requests", s.getRequests)
+	mux.HandleFunc("/ca", s.getCACertificate)
 	mux.HandleFunc("/stop", func(_ http.ResponseWriter, _ *http.Request) {
 		cancel()
 	})
@@ -133,14 +153,74 @@ func ready(w http.ResponseWriter, r *http.Request) {
 }
 
 type ForwarderStatus struct {
-	Target     `json:,inline`
-	Forwarding bool `json:"forwarding"`
+	Target
+	Forwarding bool           `json:"forwarding"`
+	State      ForwarderState `json:"state"`
+	Message    string         `json:"message,omitempty"`
+	// Loopback is the loopback address allocated to the target (Target.Loopback is the requested one).
+	Loopback string `json:"allocatedLoopback,omitempty"`
+	// ResolvedPorts is Ports with the auto local ports replaced by the allocated ones.
+	ResolvedPorts []string `json:"resolvedPorts,omitempty"`
+	// Pod is the status of the pod selected for the target.
+	Pod *PodStatus `json:"pod,omitempty"`
+	// Events are the recent Warning events related to the target when it has no ready pod.
+	Events []EventSummary `json:"events,omitempty"`
 }
 
 func (s Server) getForwarderList(w http.ResponseWriter, r *http.Request) {
 	s.renderJSON(w, s.reconciler.Status(), http.StatusOK)
 }
 
+func (s Server) handleHosts(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		s.renderJSON(w, s.reconciler.HostEntries(), http.StatusOK)
+		return
+	case http.MethodPost:
+		err = s.reconciler.ApplyHostsFile()
+	case http.MethodDelete:
+		err = s.reconciler.RemoveHostsFile()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to update hosts file", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s Server) getPort(w http.ResponseWriter, r *http.Request) {
+	port, err := s.reconciler.LookupPort(r.URL.Query().Get("target"), r.URL.Query().Get("remote"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, strconv.Itoa(port))
+}
+
+func (s Server) getRequests(w http.ResponseWriter, r *http.Request) {
+	s.renderJSON(w, s.reconciler.Requests(r.URL.Query().Get("target")), http.StatusOK)
+}
+
+func (s Server) getCACertificate(w http.ResponseWriter, r *http.Request) {
+	cert, err := s.reconciler.CACertificate()
+	if err != nil {
+		s.logger.Error("failed to load local CA", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(cert)
+}
+
 func (s Server) getLogFilePath(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	io.WriteString(w, s.logFilePath)
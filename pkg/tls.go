@@ -0,0 +1,371 @@
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	caCertFile     = "ca.crt"
+	caKeyFile      = "ca.key"
+	caValidity     = 10 * 365 * 24 * time.Hour
+	leafValidity   = 365 * 24 * time.Hour
+	defaultTLSHost = "localhost"
+	// maxCachedCerts bounds the certificates kept for the server names requested by the clients.
+	maxCachedCerts = 256
+)
+
+// The local CA is constrained to the names of the local listeners and the cluster, so that its key,
+// which users trust in their OS, cannot be used to impersonate other sites if it leaks.
+// A DNS constraint also permits its subdomains (e.g. "grafana.localhost").
+var (
+	caPermittedDNSDomains = []string{"localhost", "svc", clusterDomain}
+	caPermittedIPRanges   = []string{"127.0.0.0/8", "::1/128"}
+)
+
+// localCA issues the certificates of the TLS listeners.
+// It is created in the state directory on first use, so that it only has to be trusted once.
+type localCA struct {
+	dir string
+	// hosts are the gateway host names permitted in addition to caPermittedDNSDomains when the CA is created.
+	hosts []string
+
+	once    sync.Once
+	err     error
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+func newLocalCA(dir string) *localCA {
+	return &localCA{
+		dir:   dir,
+		certs: make(map[string]*tls.Certificate),
+	}
+}
+
+func (ca *localCA) load() error {
+	ca.once.Do(func() {
+		ca.mu.Lock()
+		defer ca.mu.Unlock()
+		ca.err = ca.loadOrCreate()
+	})
+	return ca.err
+}
+
+func (ca *localCA) loadOrCreate() error {
+	certPath := filepath.Join(ca.dir, caCertFile)
+	keyPath := filepath.Join(ca.dir, caKeyFile)
+
+	certPEM, err := os.ReadFile(certPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return ca.create(certPath, keyPath)
+	}
+	if err != nil {
+		return err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("failed to load the local CA in %s: %w", ca.dir, err)
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("unsupported key of the local CA in %s", ca.dir)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	ca.cert = cert
+	ca.key = key
+	ca.certPEM = certPEM
+	return nil
+}
+
+func (ca *localCA) create(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	var ipRanges []*net.IPNet
+	for _, cidr := range caPermittedIPRanges {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		ipRanges = append(ipRanges, ipNet)
+	}
+	domains := slices.Clone(caPermittedDNSDomains)
+	for _, host := range ca.hosts {
+		if !permitsDNSName(domains, host) {
+			domains = append(domains, host)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:                newSerialNumber(),
+		Subject:                     pkix.Name{Organization: []string{"kube-porter"}, CommonName: "kube-porter local CA " + hostname},
+		NotBefore:                   now.Add(-time.Hour),
+		NotAfter:                    now.Add(caValidity),
+		KeyUsage:                    x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid:       true,
+		IsCA:                        true,
+		MaxPathLenZero:              true,
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         domains,
+		PermittedIPRanges:           ipRanges,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.MkdirAll(ca.dir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return err
+	}
+	ca.cert = cert
+	ca.key = key
+	ca.certPEM = certPEM
+	return nil
+}
+
+// setHosts sets the gateway host names, which the CA is permitted to issue certificates for if it is created afterwards.
+func (ca *localCA) setHosts(hosts []string) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.hosts = hosts
+}
+
+// unpermittedHosts returns the hosts that the existing CA cannot issue certificates for,
+// because they were added after it was created. A CA that does not exist yet is created with all of them permitted.
+func (ca *localCA) unpermittedHosts(hosts []string) []string {
+	if len(hosts) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(ca.dir, caCertFile)); err != nil {
+		return nil
+	}
+	if err := ca.load(); err != nil {
+		return nil
+	}
+	var unpermitted []string
+	for _, host := range hosts {
+		if !ca.permits(host) {
+			unpermitted = append(unpermitted, host)
+		}
+	}
+	return unpermitted
+}
+
+// permits reports whether the name constraints of the CA allow a certificate for name.
+func (ca *localCA) permits(name string) bool {
+	if ip := net.ParseIP(name); ip != nil {
+		for _, r := range ca.cert.PermittedIPRanges {
+			if r.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return permitsDNSName(ca.cert.PermittedDNSDomains, name)
+}
+
+func permitsDNSName(domains []string, name string) bool {
+	for _, d := range domains {
+		d = strings.TrimPrefix(d, ".")
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// PEM returns the certificate of the CA to be added to trust stores.
+func (ca *localCA) PEM() ([]byte, error) {
+	if err := ca.load(); err != nil {
+		return nil, err
+	}
+	return ca.certPEM, nil
+}
+
+// getCertificate returns a certificate for the server name requested by the client.
+// Clients that do not send SNI, such as the ones connecting to an IP address, get one for the local address.
+func (ca *localCA) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if err := ca.load(); err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		name = defaultTLSHost
+		if hello.Conn != nil {
+			if addr, ok := hello.Conn.LocalAddr().(*net.TCPAddr); ok {
+				name = addr.IP.String()
+			}
+		}
+	}
+
+	if !ca.permits(name) {
+		return nil, fmt.Errorf("the local CA is not permitted to issue a certificate for %q", name)
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if cert, ok := ca.certs[name]; ok && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+	cert, err := ca.issue(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(ca.certs) >= maxCachedCerts {
+		for k := range ca.certs {
+			delete(ca.certs, k)
+			break
+		}
+	}
+	ca.certs[name] = cert
+	return cert, nil
+}
+
+func (ca *localCA) issue(name string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: newSerialNumber(),
+		Subject:      pkix.Name{Organization: []string{"kube-porter"}, CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+func newSerialNumber() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(err)
+	}
+	return serial
+}
+
+// tlsConfig returns the config of the TLS listeners of the target.
+func (f *Forwarder) tlsConfig() (*tls.Config, error) {
+	t := f.target.TLS
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+	if f.ca == nil {
+		return nil, errors.New("local CA is not available")
+	}
+	if err := f.ca.load(); err != nil {
+		return nil, fmt.Errorf("failed to load the local CA: %w", err)
+	}
+	return &tls.Config{GetCertificate: f.ca.getCertificate}, nil
+}
+
+// upstreamTLSConfig returns the config of the TLS connections to the pod.
+func (f *Forwarder) upstreamTLSConfig() (*tls.Config, error) {
+	t := f.target.UpstreamTLS
+	cfg := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if cfg.ServerName == "" {
+		if f.target.ObjectType == "Remote" {
+			cfg.ServerName = f.target.remoteHost()
+		} else {
+			cfg.ServerName = fmt.Sprintf("%s.%s.svc", f.target.Name, f.target.Namespace)
+		}
+	}
+	if t.CAFile != "" {
+		b, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate found in %s", t.CAFile)
+		}
+	}
+	return cfg, nil
+}
+
+// dialTLS returns the function that handshakes with the connections returned by dial.
+func dialTLS(dial func() (net.Conn, error), cfg *tls.Config) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with upstream failed: %w", err)
+		}
+		return tlsConn, nil
+	}
+}
@@ -0,0 +1,189 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/tools/portforward"
+)
+
+// tunnel opens connections to the ports of a pod over a single port-forward connection.
+// Unlike portforward.PortForwarder, it does not listen on local ports by itself,
+// so that any kind of local endpoint can be connected to the pod.
+type tunnel struct {
+	conn      httpstream.Connection
+	pod       string
+	requestID atomic.Int64
+}
+
+func dialTunnel(dialer httpstream.Dialer, pod string) (*tunnel, error) {
+	conn, protocol, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+	if err != nil {
+		return nil, fmt.Errorf("error upgrading connection: %w", err)
+	}
+	if protocol != portforward.PortForwardProtocolV1Name {
+		conn.Close()
+		return nil, fmt.Errorf("unable to negotiate protocol: client supports %q, server returned %q", portforward.PortForwardProtocolV1Name, protocol)
+	}
+	return &tunnel{conn: conn, pod: pod}, nil
+}
+
+func (t *tunnel) close() error {
+	return t.conn.Close()
+}
+
+// closeChan returns a channel that is closed when the connection to the pod is lost.
+func (t *tunnel) closeChan() <-chan bool {
+	return t.conn.CloseChan()
+}
+
+// dial opens a connection to the port of the pod.
+func (t *tunnel) dial(port int) (net.Conn, error) {
+	requestID := t.requestID.Add(1)
+
+	headers := http.Header{}
+	headers.Set(corev1.StreamType, corev1.StreamTypeError)
+	headers.Set(corev1.PortHeader, strconv.Itoa(port))
+	headers.Set(corev1.PortForwardRequestIDHeader, strconv.FormatInt(requestID, 10))
+	errorStream, err := t.conn.CreateStream(headers)
+	if err != nil {
+		return nil, fmt.Errorf("error creating error stream for port %d: %w", port, err)
+	}
+	// we're not writing to this stream
+	errorStream.Close()
+
+	headers.Set(corev1.StreamType, corev1.StreamTypeData)
+	dataStream, err := t.conn.CreateStream(headers)
+	if err != nil {
+		t.conn.RemoveStreams(errorStream)
+		return nil, fmt.Errorf("error creating forwarding stream for port %d: %w", port, err)
+	}
+
+	c := &streamConn{
+		tunnel:      t,
+		port:        port,
+		data:        dataStream,
+		errorStream: errorStream,
+		errCh:       make(chan error, 1),
+	}
+	go func() {
+		message, err := io.ReadAll(errorStream)
+		switch {
+		case err != nil:
+			c.errCh <- fmt.Errorf("error reading from error stream for port %d: %w", port, err)
+		case len(message) > 0:
+			c.errCh <- fmt.Errorf("an error occurred forwarding to port %d: %s", port, string(message))
+		}
+		close(c.errCh)
+	}()
+	return c, nil
+}
+
+// streamConn is a connection to a port of the pod.
+// Deadlines are not supported because the underlying streams do not support them.
+type streamConn struct {
+	tunnel      *tunnel
+	port        int
+	data        httpstream.Stream
+	errorStream httpstream.Stream
+	errCh       chan error
+
+	errOnce   sync.Once
+	err       error
+	closeOnce sync.Once
+}
+
+var _ net.Conn = &streamConn{}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	n, err := c.data.Read(b)
+	if errors.Is(err, io.EOF) {
+		// The error stream tells why the remote side has closed the connection.
+		c.errOnce.Do(func() {
+			c.err = <-c.errCh
+		})
+		if c.err != nil {
+			return n, c.err
+		}
+	}
+	return n, err
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	return c.data.Write(b)
+}
+
+// CloseWrite tells the remote side that no more data will be sent.
+func (c *streamConn) CloseWrite() error {
+	return c.data.Close()
+}
+
+func (c *streamConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.data.Close()
+		err = c.data.Reset()
+		c.tunnel.conn.RemoveStreams(c.data, c.errorStream)
+	})
+	return err
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return tunnelAddr("local")
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return tunnelAddr(net.JoinHostPort(c.tunnel.pod, strconv.Itoa(c.port)))
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "portforward" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// proxyConn copies data between the local connection and the remote one until either side is done.
+func proxyConn(local net.Conn, remote net.Conn) error {
+	defer local.Close()
+	defer remote.Close()
+
+	localErr := make(chan error, 1)
+	remoteDone := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(local, remote)
+		closeWrite(local)
+		remoteDone <- err
+	}()
+	go func() {
+		_, err := io.Copy(remote, local)
+		closeWrite(remote)
+		if err != nil {
+			localErr <- err
+		}
+	}()
+
+	select {
+	case err := <-remoteDone:
+		return err
+	case err := <-localErr:
+		return err
+	}
+}
+
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+}
@@ -0,0 +1,130 @@
+package pkg
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// udpSessionTimeout is how long a local UDP client is kept connected to the relay without any traffic.
+const udpSessionTimeout = 2 * time.Minute
+
+// listenUDP listens on the local UDP port of the mapping on every address,
+// and relays the datagrams to remote through the relay pod connected by the tunnel.
+func (f *Forwarder) listenUDP(t *tunnel, m portMapping, remote string) ([]net.PacketConn, error) {
+	conns, err := listenEach(f.listenHosts(), m.local, func(addr string) (net.PacketConn, error) {
+		return net.ListenPacket("udp", addr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, pc := range conns {
+		f.logger.Info("forwarding from udp", zap.String("address", pc.LocalAddr().String()), zap.String("remote", remote))
+		go f.serveUDP(pc, func() (net.Conn, error) {
+			return dialRelay(t, "udp", remote)
+		})
+	}
+	return conns, nil
+}
+
+type udpSession struct {
+	conn net.Conn
+
+	mu         sync.Mutex
+	lastActive time.Time
+}
+
+func (s *udpSession) touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActive = time.Now()
+}
+
+func (s *udpSession) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastActive) > udpSessionTimeout
+}
+
+// serveUDP relays the datagrams received on pc until it is closed.
+// Each local client gets its own stream, so that the replies are sent back to the right client.
+func (f *Forwarder) serveUDP(pc net.PacketConn, dial func() (net.Conn, error)) {
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, s := range sessions {
+			s.conn.Close()
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(udpSessionTimeout / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			mu.Lock()
+			for _, s := range sessions {
+				if s.idle() {
+					s.conn.Close()
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		mu.Lock()
+		s := sessions[from.String()]
+		mu.Unlock()
+		if s == nil {
+			conn, err := dial()
+			if err != nil {
+				f.logger.Error("failed to connect to relay", zap.String("client", from.String()), zap.Error(err))
+				continue
+			}
+			s = &udpSession{conn: conn, lastActive: time.Now()}
+			mu.Lock()
+			sessions[from.String()] = s
+			mu.Unlock()
+
+			go func() {
+				for {
+					b, err := readDatagram(s.conn)
+					if err != nil {
+						break
+					}
+					s.touch()
+					pc.WriteTo(b, from)
+				}
+				s.conn.Close()
+				mu.Lock()
+				if sessions[from.String()] == s {
+					delete(sessions, from.String())
+				}
+				mu.Unlock()
+			}()
+		}
+
+		s.touch()
+		if err := writeDatagram(s.conn, buf[:n]); err != nil {
+			f.logger.Debug("failed to send datagram", zap.String("client", from.String()), zap.Error(err))
+			s.conn.Close()
+		}
+	}
+}